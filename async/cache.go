@@ -0,0 +1,264 @@
+package async
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gioui.org/op/paint"
+)
+
+// DefaultCacheBytes is used when a Cache specifies no MaxBytes.
+const DefaultCacheBytes = 64 << 20
+
+// unknownSize is the size assumed for values that provide no size hint.
+const unknownSize = 1 << 10
+
+// SizeHint is implemented by values that know how many bytes of memory they
+// occupy. Values that do not implement it are sized by the Cache if they
+// are byte slices, strings, images, or image ops, and are otherwise assumed
+// to be small.
+type SizeHint interface {
+	SizeHint() int64
+}
+
+// Codec serializes values for the on-disk tier of a Cache.
+type Codec interface {
+	Encode(w io.Writer, value interface{}) error
+	Decode(r io.Reader) (interface{}, error)
+}
+
+// PNG is a Codec for image.Image values.
+var PNG Codec = pngCodec{}
+
+type pngCodec struct{}
+
+func (pngCodec) Encode(w io.Writer, value interface{}) error {
+	img, ok := value.(image.Image)
+	if !ok {
+		return fmt.Errorf("cannot encode %T as png", value)
+	}
+	return png.Encode(w, img)
+}
+
+func (pngCodec) Decode(r io.Reader) (interface{}, error) {
+	return png.Decode(r)
+}
+
+// Cache stores loaded values in two tiers, so that resources evicted from a
+// Loader can be loaded again without repeating the work: an in-memory LRU
+// bounded by size, and an optional directory on disk.
+//
+// Install a Cache as the Cache field of a Loader. Only successful loads are
+// cached.
+type Cache struct {
+	// MaxBytes bounds the size of the values held in memory. Defaults to
+	// DefaultCacheBytes.
+	MaxBytes int64
+	// Dir, if not empty, is a directory in which values are persisted, keyed
+	// by their Tag. Tags are identified by their type and formatted value,
+	// so they should be strings or other simple values.
+	Dir string
+	// Codec serializes values to and from Dir. The on-disk tier is disabled
+	// without one.
+	Codec Codec
+	// mu synchronizes the fields below.
+	mu sync.Mutex
+	// lru orders the entries from most to least recently used.
+	lru *list.List
+	// entries maps tags to their element within lru.
+	entries map[Tag]*list.Element
+	// size is the total size of the entries.
+	size int64
+}
+
+// cacheEntry is the value of an element within the lru.
+type cacheEntry struct {
+	tag   Tag
+	value interface{}
+	size  int64
+}
+
+// Get the value for tag from memory, if present.
+func (c *Cache) Get(tag Tag) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[tag]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// Put the value for tag into memory, evicting the least recently used values
+// as necessary. Values larger than MaxBytes are not held in memory.
+func (c *Cache) Put(tag Tag, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		c.lru = list.New()
+		c.entries = make(map[Tag]*list.Element)
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = DefaultCacheBytes
+	}
+	if e, ok := c.entries[tag]; ok {
+		c.drop(e)
+	}
+	size := sizeOf(value)
+	if size > c.MaxBytes {
+		return
+	}
+	c.entries[tag] = c.lru.PushFront(&cacheEntry{tag: tag, value: value, size: size})
+	c.size += size
+	for c.size > c.MaxBytes {
+		c.drop(c.lru.Back())
+	}
+}
+
+// Remove the value for tag from memory and disk.
+func (c *Cache) Remove(tag Tag) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if e, ok := c.entries[tag]; ok {
+		c.drop(e)
+	}
+	c.mu.Unlock()
+	if path, ok := c.path(tag); ok {
+		os.Remove(path)
+	}
+}
+
+// drop the entry e from memory.
+// Only call this when lock has been acquired.
+func (c *Cache) drop(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.tag)
+	c.size -= entry.size
+}
+
+// load the value for tag from memory, then disk, and finally using load,
+// populating the tiers that missed.
+func (c *Cache) load(ctx context.Context, tag Tag, load LoadErrFunc) (interface{}, error) {
+	if v, ok := c.Get(tag); ok {
+		return v, nil
+	}
+	if v, ok := c.read(tag); ok {
+		c.Put(tag, v)
+		return v, nil
+	}
+	v, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		// The load was cancelled, possibly because the value was invalidated
+		// while it was being loaded, so its result must not be cached.
+		return v, nil
+	}
+	c.Put(tag, v)
+	c.write(tag, v)
+	return v, nil
+}
+
+// path returns the file in which the value of tag is persisted, if the
+// on-disk tier is enabled.
+func (c *Cache) path(tag Tag) (string, bool) {
+	if c.Dir == "" || c.Codec == nil {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%T:%v", tag, tag)))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])), true
+}
+
+// read the value of tag from disk. Values that cannot be read are treated as
+// missing.
+func (c *Cache) read(tag Tag) (interface{}, bool) {
+	path, ok := c.path(tag)
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	v, err := c.Codec.Decode(f)
+	if err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// write the value of tag to disk. The on-disk tier is best-effort, so
+// failures only result in the value being loaded again in the future.
+func (c *Cache) write(tag Tag, value interface{}) {
+	path, ok := c.path(tag)
+	if !ok {
+		return
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return
+	}
+	// Write to a temporary file first, so that a partially written value is
+	// never read.
+	f, err := os.CreateTemp(c.Dir, "tmp-*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if err := c.Codec.Encode(f, value); err != nil {
+		f.Close()
+		return
+	}
+	if err := f.Close(); err != nil {
+		return
+	}
+	os.Rename(f.Name(), path)
+}
+
+// sizeOf estimates the bytes of memory occupied by value.
+func sizeOf(value interface{}) int64 {
+	switch v := value.(type) {
+	case SizeHint:
+		return v.SizeHint()
+	case []byte:
+		return int64(len(v))
+	case string:
+		return int64(len(v))
+	case *image.RGBA:
+		return int64(len(v.Pix))
+	case *image.NRGBA:
+		return int64(len(v.Pix))
+	case *image.Gray:
+		return int64(len(v.Pix))
+	case *image.Alpha:
+		return int64(len(v.Pix))
+	case paint.ImageOp:
+		sz := v.Size()
+		return int64(sz.X) * int64(sz.Y) * 4
+	case image.Image:
+		// Assume 4 bytes per pixel.
+		return int64(v.Bounds().Dx()) * int64(v.Bounds().Dy()) * 4
+	default:
+		return unknownSize
+	}
+}
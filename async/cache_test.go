@@ -0,0 +1,134 @@
+package async
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gioui.org/op/paint"
+)
+
+// sized is a value with a SizeHint.
+type sized int64
+
+func (s sized) SizeHint() int64 {
+	return int64(s)
+}
+
+// TestCacheEviction ensures that the least recently used values are evicted
+// once the values exceed MaxBytes.
+func TestCacheEviction(t *testing.T) {
+	c := &Cache{MaxBytes: 10}
+	c.Put("a", make([]byte, 4))
+	c.Put("b", make([]byte, 4))
+	// Using "a" makes "b" the least recently used.
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("expected a to be cached")
+	}
+	c.Put("c", make([]byte, 4))
+	for tag, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(tag); ok != want {
+			t.Errorf("expected %s to be cached: %v, got %v", tag, want, ok)
+		}
+	}
+	if c.size != 8 {
+		t.Errorf("expected 8 bytes to be cached, got %d", c.size)
+	}
+	// Replacing a value accounts for its new size.
+	c.Put("a", make([]byte, 6))
+	if c.size != 10 {
+		t.Errorf("expected 10 bytes to be cached, got %d", c.size)
+	}
+	// Values larger than the budget are not held, and evict nothing.
+	c.Put("huge", make([]byte, 11))
+	if _, ok := c.Get("huge"); ok {
+		t.Errorf("expected a value larger than MaxBytes not to be cached")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Errorf("expected c to remain cached")
+	}
+	c.Remove("c")
+	if _, ok := c.Get("c"); ok || c.size != 6 {
+		t.Errorf("expected c to be removed, leaving 6 bytes, got %d bytes", c.size)
+	}
+}
+
+// TestCacheDisk ensures that values round-trip through the Codec of the
+// on-disk tier, in files named after their tag.
+func TestCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.SetNRGBA(1, 1, color.NRGBA{R: 0xFF, A: 0xFF})
+	var calls int
+	load := func(context.Context) (interface{}, error) {
+		calls++
+		return img, nil
+	}
+	c := &Cache{Dir: dir, Codec: PNG}
+	if _, err := c.load(context.Background(), "avatar", load); err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	sum := sha256.Sum256([]byte("string:avatar"))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:]))
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the value to be persisted to %s: %v", path, err)
+	}
+
+	// A new cache finds the value on disk rather than loading it.
+	c = &Cache{Dir: dir, Codec: PNG}
+	v, err := c.load(context.Background(), "avatar", load)
+	if err != nil {
+		t.Fatalf("loading: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the value to be read from disk, got %d loads", calls)
+	}
+	got, ok := v.(image.Image)
+	if !ok || got.Bounds() != img.Bounds() || got.At(1, 1) != img.At(1, 1) || got.At(0, 0) != img.At(0, 0) {
+		t.Errorf("expected the image to round-trip, got %#v", v)
+	}
+	if _, ok := c.Get("avatar"); !ok {
+		t.Errorf("expected the value read from disk to be held in memory")
+	}
+
+	c.Remove("avatar")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the persisted value to be removed, got %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no temporary files to remain, got %v", entries)
+	}
+}
+
+// TestSizeOf ensures that values are sized by their contents.
+func TestSizeOf(t *testing.T) {
+	for _, tc := range []struct {
+		value interface{}
+		size  int64
+	}{
+		{value: sized(123), size: 123},
+		{value: make([]byte, 5), size: 5},
+		{value: "abc", size: 3},
+		{value: image.NewRGBA(image.Rect(0, 0, 2, 3)), size: 24},
+		{value: image.NewNRGBA(image.Rect(0, 0, 2, 3)), size: 24},
+		{value: image.NewGray(image.Rect(0, 0, 2, 3)), size: 6},
+		{value: image.NewAlpha(image.Rect(0, 0, 2, 3)), size: 6},
+		{value: paint.NewImageOp(image.NewGray(image.Rect(0, 0, 2, 3))), size: 24},
+		{value: image.NewGray16(image.Rect(0, 0, 2, 3)), size: 24},
+		{value: 42, size: unknownSize},
+	} {
+		if got := sizeOf(tc.value); got != tc.size {
+			t.Errorf("%v: expected a size of %d, got %d", reflect.TypeOf(tc.value), tc.size, got)
+		}
+	}
+}
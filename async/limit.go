@@ -0,0 +1,240 @@
+package async
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// LimitedScheduler is a KeyedScheduler that limits the rate at which work
+// starts, and the amount of work running concurrently for each group of keys,
+// before handing the work to another Scheduler. This avoids being throttled
+// by the hosts serving the values, for example by grouping keys by host.
+//
+// Schedule blocks until the work is allowed to start, or until its context is
+// done, so that the Loader keeps the remaining resources queued in priority
+// order. Work of a group at capacity is queued instead, so that it does not
+// hold up the work of other groups: it starts in the order it was scheduled
+// as the work of its group finishes, even if its context is done by then.
+// Queued work always runs, like any work accepted by ScheduleKey: once the
+// scheduler shuts down, it runs at once, leaving it to observe the
+// cancellation of whatever it was doing.
+type LimitedScheduler struct {
+	// Scheduler runs the work once it is allowed to start. Defaults to a
+	// FixedWorkerPool.
+	Scheduler Scheduler
+	// Rate is the maximum number of pieces of work started per second.
+	// Zero means no limit.
+	Rate float64
+	// Burst is the number of pieces of work that can start at once, after a
+	// period of inactivity, without regard to Rate. Defaults to 1.
+	Burst int
+	// Group maps the key of some work to its group, like the host of a URL.
+	// Defaults to the key itself. Groups must be hashable.
+	Group func(key Tag) Tag
+	// MaxPerGroup is the maximum amount of work running concurrently for
+	// each group. Zero means no limit.
+	MaxPerGroup int
+	// mu synchronizes the fields below.
+	mu sync.Mutex
+	// groups holds the groups with work running or queued.
+	groups map[Tag]*group
+	// next is the time at which the next piece of work can start, if the
+	// burst is exhausted.
+	next time.Time
+	// closed reports whether the scheduler is shut down.
+	closed bool
+	// ctx is cancelled by Shutdown, abandoning the work waiting to start.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// dispatching tracks the goroutines starting, or running, queued work.
+	dispatching sync.WaitGroup
+	// pool is the default Scheduler, if the scheduler created it, which is
+	// shut down along with the scheduler.
+	pool *FixedWorkerPool
+	// once time initialization.
+	once sync.Once
+}
+
+// group is the work of a group of keys.
+type group struct {
+	// running counts the work of the group holding a slot.
+	running int
+	// queue holds the work waiting for a slot, in the order it was scheduled.
+	queue []queuedWork
+}
+
+// queuedWork is work queued by ScheduleKey.
+type queuedWork struct {
+	key  Tag
+	work func()
+}
+
+// Schedule work, subject to the rate limit only.
+func (s *LimitedScheduler) Schedule(ctx context.Context, work func()) error {
+	s.once.Do(s.initialize)
+	if err := s.wait(ctx); err != nil {
+		return err
+	}
+	return s.Scheduler.Schedule(ctx, work)
+}
+
+// ScheduleKey schedules the work of loading the value with the given key,
+// subject to both the rate limit and the limit of its group. This is a
+// blocking call until the work is allowed to start, or until ctx is done,
+// unless its group is at capacity, in which case the work is queued.
+func (s *LimitedScheduler) ScheduleKey(ctx context.Context, key Tag, work func()) error {
+	s.once.Do(s.initialize)
+	name := key
+	if s.Group != nil {
+		name = s.Group(key)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrShutdown
+	}
+	g, ok := s.groups[name]
+	if !ok {
+		g = &group{}
+		s.groups[name] = g
+	}
+	if s.MaxPerGroup > 0 && g.running >= s.MaxPerGroup {
+		g.queue = append(g.queue, queuedWork{key: key, work: work})
+		s.mu.Unlock()
+		return nil
+	}
+	g.running++
+	s.mu.Unlock()
+	return s.start(ctx, name, key, work)
+}
+
+// Shutdown stops the scheduler: work waiting to start fails with
+// ErrShutdown, whereas queued work, which ScheduleKey accepted, runs at once
+// regardless of the limits. The default Scheduler is shut down too, whereas a
+// Scheduler provided by the caller is left to the caller. If ctx is done
+// before the queued work, and the work of the default Scheduler, finishes,
+// Shutdown returns ctx.Err().
+func (s *LimitedScheduler) Shutdown(ctx context.Context) error {
+	s.once.Do(s.initialize)
+	s.mu.Lock()
+	s.closed = true
+	var queued []queuedWork
+	for _, g := range s.groups {
+		queued = append(queued, g.queue...)
+		g.queue = nil
+	}
+	s.mu.Unlock()
+	s.cancel()
+	for _, q := range queued {
+		s.run(q.work)
+	}
+	err := wait(ctx, &s.dispatching)
+	if s.pool != nil {
+		if perr := s.pool.Shutdown(ctx); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+func (s *LimitedScheduler) initialize() {
+	if s.Scheduler == nil {
+		s.pool = &FixedWorkerPool{}
+		s.Scheduler = s.pool
+	}
+	s.groups = make(map[Tag]*group)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+}
+
+// start work of the group holding a slot, once the rate limit allows it.
+// The slot is released once the work is done, or if it fails to start.
+func (s *LimitedScheduler) start(ctx context.Context, name, key Tag, work func()) error {
+	err := s.wait(ctx)
+	if err == nil {
+		err = schedule(ctx, s.Scheduler, key, func() {
+			defer s.release(name)
+			work()
+		})
+	}
+	if err != nil {
+		s.release(name)
+	}
+	return err
+}
+
+// release a slot held by the group, handing it to the next queued work of
+// the group, if any.
+func (s *LimitedScheduler) release(name Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.groups[name]
+	if len(g.queue) > 0 {
+		next := g.queue[0]
+		g.queue = g.queue[1:]
+		s.dispatching.Add(1)
+		go func() {
+			defer s.dispatching.Done()
+			if err := s.start(s.ctx, name, next.key, next.work); err != nil {
+				// The work was accepted, so it runs nonetheless.
+				next.work()
+			}
+		}()
+		return
+	}
+	if g.running--; g.running <= 0 {
+		delete(s.groups, name)
+	}
+}
+
+// run queued work at once, in the background.
+func (s *LimitedScheduler) run(work func()) {
+	s.dispatching.Add(1)
+	go func() {
+		defer s.dispatching.Done()
+		work()
+	}()
+}
+
+// wait until the rate limit allows the next piece of work to start, or until
+// ctx is done, in which case the reserved start is given back.
+func (s *LimitedScheduler) wait(ctx context.Context) error {
+	if err := s.ctx.Err(); err != nil {
+		return ErrShutdown
+	}
+	if s.Rate <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / s.Rate)
+	burst := s.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	s.mu.Lock()
+	// Unused capacity accumulates up to the burst.
+	if earliest := time.Now().Add(-interval * time.Duration(burst-1)); s.next.Before(earliest) {
+		s.next = earliest
+	}
+	start := s.next
+	s.next = s.next.Add(interval)
+	s.mu.Unlock()
+	timer := time.NewTimer(time.Until(start))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		s.refund(interval)
+		return ctx.Err()
+	case <-s.ctx.Done():
+		s.refund(interval)
+		return ErrShutdown
+	}
+}
+
+// refund a start reserved by wait, which did not happen.
+func (s *LimitedScheduler) refund(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next = s.next.Add(-interval)
+}
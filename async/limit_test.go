@@ -0,0 +1,260 @@
+package async
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLimitedSchedulerGroups ensures that the work of each group never runs
+// beyond the concurrency limit, while other groups proceed.
+func TestLimitedSchedulerGroups(t *testing.T) {
+	s := &LimitedScheduler{
+		Scheduler: &DynamicWorkerPool{Workers: 8},
+		Group: func(key Tag) Tag {
+			host, _, _ := strings.Cut(key.(string), "/")
+			return host
+		},
+		MaxPerGroup: 2,
+	}
+	var (
+		mu      sync.Mutex
+		running = map[Tag]int{}
+		peak    = map[Tag]int{}
+		wg      sync.WaitGroup
+	)
+	for ii := 0; ii < 20; ii++ {
+		host := []string{"a", "b"}[ii%2]
+		wg.Add(1)
+		s.ScheduleKey(context.Background(), host+"/"+string(rune('a'+ii)), func() {
+			defer wg.Done()
+			mu.Lock()
+			running[host]++
+			if running[host] > peak[host] {
+				peak[host] = running[host]
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running[host]--
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	for _, host := range []string{"a", "b"} {
+		if peak[host] < 1 || peak[host] > 2 {
+			t.Errorf("expected at most 2 concurrent loads from %q, got %d", host, peak[host])
+		}
+	}
+}
+
+// TestLimitedSchedulerRate ensures that work starts no faster than the rate
+// once the burst is exhausted.
+func TestLimitedSchedulerRate(t *testing.T) {
+	s := &LimitedScheduler{
+		Scheduler: &FixedWorkerPool{Workers: 4},
+		Rate:      100,
+		Burst:     2,
+	}
+	var wg sync.WaitGroup
+	start := time.Now()
+	for ii := 0; ii < 6; ii++ {
+		wg.Add(1)
+		s.Schedule(context.Background(), wg.Done)
+	}
+	wg.Wait()
+	// Two start immediately, and the remaining four 10ms apart.
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Errorf("expected the rate to be limited, all work started within %v", elapsed)
+	}
+}
+
+// TestLimitedSchedulerQueue ensures that work of a group at capacity is
+// queued without holding up the work of other groups, and starts in order
+// once the work of its group finishes.
+func TestLimitedSchedulerQueue(t *testing.T) {
+	s := &LimitedScheduler{
+		Scheduler:   &DynamicWorkerPool{Workers: 4},
+		MaxPerGroup: 1,
+	}
+	defer s.Shutdown(context.Background())
+	release := make(chan struct{})
+	if err := s.ScheduleKey(context.Background(), "a", func() { <-release }); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+	ran := make(chan string, 3)
+	for _, key := range []string{"a", "a"} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := s.ScheduleKey(ctx, key, func() { ran <- key })
+		cancel()
+		if err != nil {
+			t.Fatalf("expected the work of the full group to be queued, got %v", err)
+		}
+	}
+	if err := s.ScheduleKey(context.Background(), "b", func() { ran <- "b" }); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+	select {
+	case key := <-ran:
+		if key != "b" {
+			t.Errorf("expected b to run while a is at capacity, got %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected b to run while a is at capacity")
+	}
+	close(release)
+	for ii := 0; ii < 2; ii++ {
+		select {
+		case key := <-ran:
+			if key != "a" {
+				t.Errorf("expected the queued work of a to run, got %s", key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the queued work of a to run once the group has capacity")
+		}
+	}
+}
+
+// TestLimitedSchedulerCancel ensures that work waiting for the rate limit
+// gives up once its context is done, giving back its start.
+func TestLimitedSchedulerCancel(t *testing.T) {
+	s := &LimitedScheduler{
+		Scheduler: &ManualScheduler{},
+		Rate:      10,
+	}
+	if err := s.Schedule(context.Background(), func() {}); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+	for ii := 0; ii < 3; ii++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := s.ScheduleKey(ctx, "a", func() {})
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected the rate limited work to time out, got %v", err)
+		}
+	}
+	// The cancelled work gave back its starts, so the next piece of work
+	// starts 100ms after the first rather than after the cancelled ones.
+	start := time.Now()
+	if err := s.Schedule(context.Background(), func() {}); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("expected the cancelled work to give back its starts, waited %v", elapsed)
+	}
+}
+
+// TestLimitedSchedulerShutdown ensures that Shutdown runs the queued work,
+// stops the default Scheduler, and fails work scheduled afterwards.
+func TestLimitedSchedulerShutdown(t *testing.T) {
+	s := &LimitedScheduler{MaxPerGroup: 1}
+	started, release := make(chan struct{}), make(chan struct{})
+	if err := s.ScheduleKey(context.Background(), "a", func() {
+		close(started)
+		<-release
+	}); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+	<-started
+	var queued int32
+	if err := s.ScheduleKey(context.Background(), "a", func() { atomic.AddInt32(&queued, 1) }); err != nil {
+		t.Fatalf("scheduling: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected Shutdown to wait for the running work, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("expected Shutdown to succeed, got %v", err)
+	}
+	if n := atomic.LoadInt32(&queued); n != 1 {
+		t.Errorf("expected the queued work to run once, ran %d times", n)
+	}
+	if err := s.ScheduleKey(context.Background(), "b", func() {}); err != ErrShutdown {
+		t.Errorf("expected scheduling to fail after shutdown, got %v", err)
+	}
+	if err := s.pool.Schedule(context.Background(), func() {}); err != ErrShutdown {
+		t.Errorf("expected the default pool to be shut down, got %v", err)
+	}
+}
+
+// TestLimitedSchedulerLoader ensures that the resources of a Loader whose
+// loads are queued by the scheduler do not remain queued once it shuts down,
+// whether or not the Loader shut down first.
+func TestLimitedSchedulerLoader(t *testing.T) {
+	t.Run("scheduler", testLimitedSchedulerLoader(false))
+	t.Run("loader", testLimitedSchedulerLoader(true))
+}
+
+func testLimitedSchedulerLoader(loaderFirst bool) func(t *testing.T) {
+	return func(t *testing.T) {
+		pool := &FixedWorkerPool{Workers: 2}
+		defer pool.Shutdown(context.Background())
+		s := &LimitedScheduler{
+			Scheduler:   pool,
+			Group:       func(Tag) Tag { return "host" },
+			MaxPerGroup: 1,
+		}
+		l := &TypedLoader[string, int]{Loader: Loader{Scheduler: s}}
+		started := make(chan struct{})
+		loads := map[string]TypedLoadFunc[int]{
+			"a": func(ctx context.Context) int {
+				close(started)
+				<-ctx.Done()
+				return 1
+			},
+			"b": func(context.Context) int {
+				return 2
+			},
+		}
+		frame := func() map[string]TypedResource[int] {
+			rs := make(map[string]TypedResource[int])
+			l.Step(func() {
+				for _, tag := range []string{"a", "b"} {
+					rs[tag] = l.Schedule(tag, loads[tag])
+				}
+			})
+			l.Sync()
+			return rs
+		}
+		frame()
+		<-started
+		// The load of b is queued behind that of a, within the same group.
+		stop := func() {
+			// Cancel the load of a.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			l.ShutdownContext(ctx)
+		}
+		if loaderFirst {
+			stop()
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatalf("shutting down: %v", err)
+		}
+		if loaderFirst {
+			// Wait for the queued load, if the pool runs it.
+			pool.Shutdown(context.Background())
+			l.loader.mu.Lock()
+			b := l.loader.lookup["b"]
+			l.loader.mu.Unlock()
+			if r := b.Get(); r.State != Failed || r.Err != ErrShutdown {
+				t.Errorf("expected the queued load to fail, got %+v", r)
+			}
+			return
+		}
+		if rs := frame(); rs["b"].State != Loaded || rs["b"].Value != 2 {
+			t.Errorf("expected the queued load to run, got %+v", rs["b"])
+		}
+		stop()
+	}
+}
@@ -3,9 +3,15 @@ package async
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"gioui.org/layout"
 )
@@ -14,15 +20,55 @@ import (
 type Tag interface{}
 
 // LoadFunc function that performs the blocking load.
-type LoadFunc func(ctx context.Context) interface{}
+type LoadFunc = TypedLoadFunc[interface{}]
+
+// LoadErrFunc function that performs the blocking load, reporting whether
+// it failed.
+type LoadErrFunc = TypedLoadErrFunc[interface{}]
+
+// TypedLoadFunc function that performs the blocking load of a value of type V.
+type TypedLoadFunc[V any] func(ctx context.Context) V
+
+// TypedLoadErrFunc function that performs the blocking load of a value of
+// type V, reporting whether it failed.
+type TypedLoadErrFunc[V any] func(ctx context.Context) (V, error)
+
+// ProgressFunc publishes an intermediate value of a load, such as a blurred
+// thumbnail of an image, along with the progress of the load in the range
+// [0,1]. A nil partial value leaves the previous one in place.
+type ProgressFunc func(partial interface{}, progress float32)
+
+// progressKey is the context key of the ProgressFunc of a load.
+type progressKey struct{}
+
+// Progress returns the ProgressFunc of the load running with ctx. Loads that
+// can report their progress should retrieve it from the context passed to
+// their LoadFunc. Loads running outside of a Loader receive a ProgressFunc
+// that does nothing.
+func Progress(ctx context.Context) ProgressFunc {
+	if report, ok := ctx.Value(progressKey{}).(ProgressFunc); ok {
+		return report
+	}
+	return func(interface{}, float32) {}
+}
 
 // Resource is an async entity that can be in various states and potentially
 // contain a value.
-type Resource struct {
+type Resource = TypedResource[interface{}]
+
+// TypedResource is a Resource containing a value of type V.
+type TypedResource[V any] struct {
 	// State reports current state for this resource.
 	State State
-	// Value for the resource. Nil if not ready.
-	Value interface{}
+	// Value for the resource. The zero value if not ready. While Loading,
+	// Value holds the most recent partial value reported by the load, if any.
+	Value V
+	// Progress of the load in the range [0,1], as reported by the load while
+	// Loading. Loaded resources have a Progress of 1.
+	Progress float32
+	// Err reported by the most recent attempt to load the resource, if it
+	// Failed, or if a Refresh of the resource failed.
+	Err error
 }
 
 // State that an async Resource can be in.
@@ -32,8 +78,54 @@ const (
 	Queued State = iota
 	Loading
 	Loaded
+	// Failed indicates that the most recent attempt to load the resource
+	// returned an error. The resource is retried according to the
+	// RetryPolicy of the Loader.
+	Failed
 )
 
+// Priority of a resource, determining the order in which resources touched
+// during the same frame are loaded.
+type Priority uint8
+
+const (
+	// Visible resources are currently on screen, and are loaded first.
+	Visible Priority = iota
+	// Prefetch resources are expected to be needed soon, and are loaded
+	// after visible ones.
+	Prefetch
+)
+
+// ScheduleOption configures the scheduling of a resource.
+type ScheduleOption func(*scheduleOptions)
+
+type scheduleOptions struct {
+	priority Priority
+	key      Tag
+}
+
+// WithPriority schedules the resource with the given priority. Resources
+// are Visible by default.
+func WithPriority(p Priority) ScheduleOption {
+	return func(o *scheduleOptions) {
+		o.priority = p
+	}
+}
+
+// WithKey identifies the underlying value of the resource by key rather than
+// by its tag. Resources with the same key share a single load: while one of
+// them is loading, the rest wait for its result instead of loading the value
+// again. This allows many widgets to display the same value, like the avatar
+// of a user, each with their own tag.
+//
+// Resources with the same key must load the same value. The key is also used
+// to identify the value in the Cache.
+func WithKey(key Tag) ScheduleOption {
+	return func(o *scheduleOptions) {
+		o.key = key
+	}
+}
+
 // Loader is an asynchronously loaded resource.
 // Start and poll a resource with Schedule method.
 // Track frames with Frame method to detect stale data.
@@ -46,15 +138,27 @@ type Loader struct {
 	// MaxLoaded specifies the maximum number of resources to load before
 	// de-allocating old resources.
 	MaxLoaded int
-	// active frame being layed out.
-	// Access must be synchronized with atomics.
-	active int64
-	// finished frames that have been layed out.
-	// Access must be synchronized with atomics.
-	finished int64
+	// Retry specifies how failed loads are retried. The zero value never
+	// retries.
+	Retry RetryPolicy
+	// Cache, if not nil, holds loaded values beyond their eviction from the
+	// loader, so that they can be loaded again quickly.
+	Cache *Cache
+	// scope tracks the frames laid out by Frame.
+	scope scope
+	// scopes are the open scopes created by NewScope.
+	// Access is synchronized by scopesMu.
+	scopes   map[*FrameScope]struct{}
+	scopesMu sync.Mutex
 	// update chan reports that a resource's status has changed.
 	// Useful for invalidating the window.
+	// It is closed by Shutdown, along with the channel of each scope, once
+	// closed is set. Access to closed is synchronized by scopesMu.
 	updated chan struct{}
+	closed  bool
+	// pool is the default Scheduler, if the loader created it, which is shut
+	// down along with the loader.
+	pool *FixedWorkerPool
 	// init allows Loader to have a useful zero value by lazily allocating on
 	// first use.
 	init sync.Once
@@ -68,10 +172,78 @@ type Loader struct {
 // Implementations can implement the best way to distribute work for a given
 // application.
 //
-// TODO(jfm): context cancellation.
+// The Loader hands work to the Scheduler in priority order, one piece at a
+// time, re-evaluating the priorities of the remaining resources after every
+// call. Schedule should therefore block while no worker is available, rather
+// than queue up work that could be superseded by the next frame.
+//
+// While blocked, Schedule must give up once its context is done, returning
+// ctx.Err(). The Loader cancels the context when the resource is no longer
+// wanted, or when it is shut down, so that it is never stalled by a
+// saturated Scheduler.
 type Scheduler interface {
-	// Schedule a piece of work. This method is allowed to block.
-	Schedule(func())
+	// Schedule a piece of work. This method is allowed to block until the
+	// work is handed to a worker, or until ctx is done. The work is run if
+	// and only if the returned error is nil.
+	Schedule(ctx context.Context, work func()) error
+}
+
+// KeyedScheduler is a Scheduler that distinguishes the work of loading
+// different values, such as to limit the concurrent loads from each host.
+// The Loader uses ScheduleKey in place of Schedule when it is available.
+type KeyedScheduler interface {
+	Scheduler
+	// ScheduleKey schedules the work of loading the value with the given key
+	// (see WithKey). It blocks and fails like Schedule.
+	ScheduleKey(ctx context.Context, key Tag, work func()) error
+}
+
+// ErrShutdown is returned by the worker pools when work is scheduled after
+// they have been shut down.
+var ErrShutdown = errors.New("async: scheduler is shut down")
+
+// schedule work with s, passing along the key if s is a KeyedScheduler.
+func schedule(ctx context.Context, s Scheduler, key Tag, work func()) error {
+	if ks, ok := s.(KeyedScheduler); ok {
+		return ks.ScheduleKey(ctx, key, work)
+	}
+	return s.Schedule(ctx, work)
+}
+
+// RetryPolicy specifies how failed loads are retried, using exponential
+// backoff.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of times a failed load is retried.
+	MaxRetries int
+	// Backoff is the delay before the first retry.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier scales the delay after each retry. Defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction, in the range [0,1], of each delay that is
+	// randomized. Jitter spreads out the retries of resources that failed
+	// at the same time, such as when the network drops.
+	Jitter float64
+}
+
+// Delay returns the delay before the given retry, counting from 1, and
+// whether that retry should happen at all.
+func (p RetryPolicy) Delay(retry int) (time.Duration, bool) {
+	if retry < 1 || retry > p.MaxRetries {
+		return 0, false
+	}
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	delay := float64(p.Backoff) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	jitter := math.Max(0, math.Min(p.Jitter, 1))
+	delay -= delay * jitter * rand.Float64()
+	return time.Duration(delay), true
 }
 
 // FixedWorkerPool implements a simple fixed-size worker pool that lets go
@@ -84,29 +256,57 @@ type FixedWorkerPool struct {
 	Workers int
 	// queue of work. Unbuffered so it will block if worker pull is at capacity.
 	queue chan func()
+	// done is closed to stop the workers.
+	done chan struct{}
+	// workers tracks the running workers.
+	workers sync.WaitGroup
+	// stop ensures that the pool is only shut down once.
+	stop sync.Once
 	// once time initialization.
 	sync.Once
 }
 
 // Schedule work to be executed by the available workers. This is a blocking
-// call if all workers are busy.
-func (p *FixedWorkerPool) Schedule(work func()) {
+// call if all workers are busy, until ctx is done. Work scheduled after
+// Shutdown fails with ErrShutdown.
+func (p *FixedWorkerPool) Schedule(ctx context.Context, work func()) error {
 	p.Once.Do(func() {
 		p.queue = make(chan func())
+		p.done = make(chan struct{})
 		if p.Workers <= 0 {
 			p.Workers = runtime.NumCPU()
 		}
+		p.workers.Add(p.Workers)
 		for ii := 0; ii < p.Workers; ii++ {
 			go func() {
-				for w := range p.queue {
-					if w != nil {
-						w()
+				defer p.workers.Done()
+				for {
+					select {
+					case w := <-p.queue:
+						if w != nil {
+							w()
+						}
+					case <-p.done:
+						return
 					}
 				}
 			}()
 		}
 	})
-	p.queue <- work
+	return send(ctx, p.queue, p.done, work)
+}
+
+// Shutdown stops the workers once they finish their current work, and waits
+// for them to exit. If ctx is done first, Shutdown returns ctx.Err() and the
+// workers exit in the background.
+func (p *FixedWorkerPool) Shutdown(ctx context.Context) error {
+	p.Once.Do(func() {
+		p.done = make(chan struct{})
+	})
+	p.stop.Do(func() {
+		close(p.done)
+	})
+	return wait(ctx, &p.workers)
 }
 
 // DynamicWorkerPool implements a simple dynamic-sized worker pool that spins up
@@ -127,32 +327,49 @@ type DynamicWorkerPool struct {
 	count chan struct{}
 	// queue of work. Unbuffered so it will block if worker pool is at capacity.
 	queue chan func()
+	// done is closed to stop the pool.
+	done chan struct{}
+	// workers tracks the running goroutines of the pool.
+	workers sync.WaitGroup
+	// stop ensures that the pool is only shut down once.
+	stop sync.Once
 	// once time initialization.
 	sync.Once
 }
 
 // Schedule work to be executed by the available workers. This is a blocking
-// call if all workers are busy.
+// call if all workers are busy, until ctx is done. Work scheduled after
+// Shutdown fails with ErrShutdown.
 //
 // Workers are limited by a buffer of semaphores.
 // Each worker holds a semaphore for the duration of it's life and returns it
 // before exiting.
-func (p *DynamicWorkerPool) Schedule(work func()) {
+func (p *DynamicWorkerPool) Schedule(ctx context.Context, work func()) error {
 	p.Once.Do(func() {
 		if p.Workers <= 0 {
 			p.Workers = int64(runtime.NumCPU())
 		}
 		p.queue = make(chan func())
+		p.done = make(chan struct{})
 		p.count = make(chan struct{}, p.Workers)
 		for ii := 0; ii < int(p.Workers); ii++ {
 			p.count <- struct{}{}
 		}
+		p.workers.Add(1)
 		go func() {
-			for w := range p.queue {
-				w := w
+			defer p.workers.Done()
+			for {
+				var w func()
+				select {
+				case w = <-p.queue:
+				case <-p.done:
+					return
+				}
 				if w != nil {
 					sem := <-p.count
+					p.workers.Add(1)
 					go func() {
+						defer p.workers.Done()
 						w()
 						p.count <- sem
 					}()
@@ -160,7 +377,93 @@ func (p *DynamicWorkerPool) Schedule(work func()) {
 			}
 		}()
 	})
-	p.queue <- work
+	return send(ctx, p.queue, p.done, work)
+}
+
+// Shutdown stops the pool from starting new workers, and waits for the
+// running ones to finish their work. If ctx is done first, Shutdown returns
+// ctx.Err() and the workers exit in the background.
+func (p *DynamicWorkerPool) Shutdown(ctx context.Context) error {
+	p.Once.Do(func() {
+		p.done = make(chan struct{})
+	})
+	p.stop.Do(func() {
+		close(p.done)
+	})
+	return wait(ctx, &p.workers)
+}
+
+// send work to the workers of a pool through queue, unless ctx or the pool is
+// done first.
+func send(ctx context.Context, queue chan<- func(), done <-chan struct{}, work func()) error {
+	select {
+	case queue <- work:
+		return nil
+	case <-done:
+		return ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait for wg, or until ctx is done, in which case ctx.Err() is returned.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ManualScheduler queues work until RunPending is called, running it on the
+// calling goroutine. It makes loading deterministic, which is useful for
+// testing code built on a Loader.
+//
+// Schedule never blocks, so the Loader hands over every queued resource at
+// once, in priority order.
+type ManualScheduler struct {
+	mu      sync.Mutex
+	pending []func()
+}
+
+// Schedule queues work until the next call to RunPending, unless ctx is
+// already done.
+func (s *ManualScheduler) Schedule(ctx context.Context, work func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, work)
+	return nil
+}
+
+// Pending reports the amount of queued work.
+func (s *ManualScheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// RunPending runs the queued work in the order it was scheduled, returning
+// the number of pieces of work run. Work scheduled meanwhile remains queued.
+func (s *ManualScheduler) RunPending() int {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	for _, work := range pending {
+		if work != nil {
+			work()
+		}
+	}
+	return len(pending)
 }
 
 // loader wraps up state that needs to be synchronized together.
@@ -170,11 +473,45 @@ type loader struct {
 	// refresh sleeps the loop, ensuring we only try to process the queue when
 	// something has actually changed.
 	refresh sync.Cond
+	// dirty reports whether something has changed since the loop last
+	// processed the queue. Use wake to set it.
+	dirty bool
+	// settled is signalled when the loop goes to sleep or stops.
+	settled sync.Cond
+	// asleep reports whether the loop is waiting for changes, and stopped
+	// whether it has stopped.
+	asleep, stopped bool
+	// closing reports whether the loader is shutting down, in which case the
+	// loop stops and no more loads start.
+	closing bool
+	// done is closed once the loop has stopped.
+	done chan struct{}
+	// working tracks the loads in progress.
+	working sync.WaitGroup
+	// dispatching, if not nil, cancels the scheduling of a load by the loop.
+	dispatching context.CancelFunc
+	// retries holds the timers of the failed resources waiting to be
+	// retried, which are stopped on shutdown.
+	retries map[*time.Timer]struct{}
 	// lookup is a map of async resources mapped to a unique tag similar to
 	// gio router api. Tag value must be a hashable type.
 	lookup map[Tag]*resource
 	// queue of resources to process in sequence.
 	queue []*resource
+	// loading is the set of resources currently being loaded.
+	loading map[*resource]struct{}
+	// flights maps keys to the load in progress for them.
+	flights map[Tag]*flight
+	// counters aggregate the activity reported by Stats.
+	counters counters
+}
+
+// counters aggregate the activity of a loader since its creation.
+// Access is synchronized by the loader mutex.
+type counters struct {
+	hits, misses, loads, failures, cancellations, evictions int
+	// loadTime is the total time spent in loads.
+	loadTime time.Duration
 }
 
 // Updated returns a channel that reports whether loader has been updated.
@@ -194,14 +531,49 @@ func (l *Loader) Updated() <-chan struct{} {
 // loader during it's layout.
 //
 // A frame is currently updating if activeFrame < finishedFrame.
+//
+// To share a Loader between several views, such as windows, give each view
+// its own FrameScope instead (see NewScope).
 func (l *Loader) Frame(gtx layout.Context, w layout.Widget) layout.Dimensions {
-	atomic.AddInt64(&l.active, 1)
-	dim := w(gtx)
-	atomic.StoreInt64(&l.finished, atomic.LoadInt64(&l.active))
-	l.refresh.Signal()
+	var dim layout.Dimensions
+	l.Step(func() {
+		dim = w(gtx)
+	})
 	return dim
 }
 
+// Step counts a frame during which fn schedules resources, like Frame does
+// for a widget. It allows resources to be scheduled outside of layout, such
+// as when stepping through frames in tests.
+func (l *Loader) Step(fn func()) {
+	l.step(&l.scope, fn)
+}
+
+// step counts a frame of sc during which fn schedules resources.
+func (l *Loader) step(sc *scope, fn func()) {
+	atomic.AddInt64(&sc.active, 1)
+	fn()
+	atomic.StoreInt64(&sc.finished, atomic.LoadInt64(&sc.active))
+	l.loader.mu.Lock()
+	l.loader.wake()
+	l.loader.mu.Unlock()
+}
+
+// Sync waits until the loader has processed every change made so far: stale
+// resources have been purged, and queued resources handed to the Scheduler.
+// It does not wait for the loads themselves.
+//
+// Together with a ManualScheduler and Step, Sync makes the loading of
+// resources deterministic.
+func (l *Loader) Sync() {
+	l.init.Do(l.initialize)
+	l.loader.mu.Lock()
+	defer l.loader.mu.Unlock()
+	for !l.loader.stopped && (l.loader.dirty || !l.loader.asleep) {
+		l.loader.settled.Wait()
+	}
+}
+
 // DefaultMaxLoaded is used when no max is specified.
 const DefaultMaxLoaded = 10
 
@@ -213,9 +585,36 @@ const DefaultMaxLoaded = 10
 //
 // The first call will queue up the load, subsequent calls will poll for the
 // status.
-func (l *Loader) Schedule(tag Tag, load LoadFunc) Resource {
+//
+// Resources touched during the most recent frame are loaded first, followed
+// by the rest in order of priority (see WithPriority). The priority of a
+// resource can change each time it is scheduled.
+//
+// Long loads can publish partial values and their progress through the
+// ProgressFunc returned by Progress for their context. Each report updates
+// the Value and Progress of the Loading resource, and is signalled on the
+// Updated channel.
+func (l *Loader) Schedule(tag Tag, load LoadFunc, opts ...ScheduleOption) Resource {
+	return l.ScheduleErr(tag, func(ctx context.Context) (interface{}, error) {
+		return load(ctx), nil
+	}, opts...)
+}
+
+// ScheduleErr is like Schedule, but the load may fail. A failed resource is
+// reported in the Failed state along with the error, and is retried
+// according to the Retry policy for as long as it remains scheduled.
+func (l *Loader) ScheduleErr(tag Tag, load LoadErrFunc, opts ...ScheduleOption) Resource {
+	return l.schedule(&l.scope, tag, load, opts)
+}
+
+// schedule a resource on behalf of sc.
+func (l *Loader) schedule(sc *scope, tag Tag, load LoadErrFunc, opts []ScheduleOption) Resource {
 	l.init.Do(l.initialize)
-	return l.loader.establish(tag, load, atomic.LoadInt64(&l.active))
+	o := scheduleOptions{key: tag}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return l.loader.establish(tag, o.key, l.Cache, load, o.priority, sc)
 }
 
 func (l *Loader) initialize() {
@@ -224,33 +623,93 @@ func (l *Loader) initialize() {
 	}
 	l.updated = make(chan struct{}, 1)
 	l.loader.lookup = make(map[Tag]*resource)
+	l.loader.loading = make(map[*resource]struct{})
+	l.loader.flights = make(map[Tag]*flight)
+	l.loader.retries = make(map[*time.Timer]struct{})
 	l.loader.refresh.L = &l.loader.mu
+	l.loader.settled.L = &l.loader.mu
+	l.loader.done = make(chan struct{})
 	if l.Scheduler == nil {
-		l.Scheduler = &FixedWorkerPool{Workers: l.MaxLoaded}
+		l.pool = &FixedWorkerPool{Workers: l.MaxLoaded}
+		l.Scheduler = l.pool
 	}
-	// TODO(jfm): expose context in the public api so that loads can be
-	// cancelled by it.
 	// Egon's example ran this at the top of the event loop. By placing it
-	// here we achieve useful zero-value but since the context is not
-	// exposed, it's useless.
+	// here we achieve useful zero-value. The context is cancelled by Shutdown.
 	ctx, cancel := context.WithCancel(context.Background())
 	l.cancel = cancel
 	go l.run(ctx)
 }
 
-// LoaderStats tracks some stats about the loader.
+// LoaderStats is a snapshot of the state and activity of a loader. The
+// counts of activity accumulate from the creation of the loader.
 type LoaderStats struct {
+	// Lookup is the number of resources held by the loader.
 	Lookup int
+	// Queued is the number of resources waiting to be loaded.
 	Queued int
+	// InFlight is the number of loads in progress, including those waiting
+	// for a worker. Resources sharing a key share a load.
+	InFlight int
+	// Hits counts the new resources whose value was served from the memory
+	// tier of the Cache, and Misses those that had to be loaded.
+	Hits, Misses int
+	// Loads counts the completed loads, and Failures those that returned an
+	// error.
+	Loads, Failures int
+	// Cancellations counts the loads cancelled before they completed, because
+	// their resources were no longer being laid out, or the loader shut down.
+	Cancellations int
+	// LoadTime is the total time spent in completed loads.
+	LoadTime time.Duration
+	// Evictions counts the resources removed because they were no longer
+	// being laid out.
+	Evictions int
+}
+
+// HitRatio is the fraction of new resources served from the Cache, or zero if
+// there were none.
+func (s LoaderStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// MeanLoadTime is the average duration of the completed loads, or zero if
+// there were none.
+func (s LoaderStats) MeanLoadTime() time.Duration {
+	if s.Loads == 0 {
+		return 0
+	}
+	return s.LoadTime / time.Duration(s.Loads)
+}
+
+// String summarizes the stats, one per line.
+func (s LoaderStats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "resources: %d, queued %d, in flight %d\n", s.Lookup, s.Queued, s.InFlight)
+	fmt.Fprintf(&b, "cache: %d hits, %d misses (%.0f%%)\n", s.Hits, s.Misses, s.HitRatio()*100)
+	fmt.Fprintf(&b, "loads: %d, %d failed, %d cancelled, mean %v\n", s.Loads, s.Failures, s.Cancellations, s.MeanLoadTime())
+	fmt.Fprintf(&b, "evictions: %d", s.Evictions)
+	return b.String()
 }
 
 // Stats reports runtime data about this loader.
-func (l *loader) Stats() LoaderStats {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+func (l *Loader) Stats() LoaderStats {
+	l.loader.mu.Lock()
+	defer l.loader.mu.Unlock()
+	c := l.loader.counters
 	return LoaderStats{
-		Lookup: len(l.lookup),
-		Queued: len(l.queue),
+		Lookup:        len(l.loader.lookup),
+		Queued:        len(l.loader.queue),
+		InFlight:      len(l.loader.flights),
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Loads:         c.loads,
+		Failures:      c.failures,
+		Cancellations: c.cancellations,
+		LoadTime:      c.loadTime,
+		Evictions:     c.evictions,
 	}
 }
 
@@ -260,110 +719,417 @@ func (l *loader) Stats() LoaderStats {
 // This is particularly useful for invaliding the window, forcing a re-layout
 // immediately.
 func (l *Loader) update() {
+	l.scopesMu.Lock()
+	defer l.scopesMu.Unlock()
+	if l.closed {
+		return
+	}
+	notify(l.updated)
+	for sc := range l.scopes {
+		notify(sc.updated)
+	}
+}
+
+// notify ch without blocking.
+func notify(ch chan struct{}) {
 	select {
-	case l.updated <- struct{}{}:
+	case ch <- struct{}{}:
 	default:
 	}
 }
 
-// Shutdown ends the background processing of the loader, if any is happening.
+// Shutdown ends the background processing of the loader, and waits for the
+// loads in progress to complete (see ShutdownContext).
 func (l *Loader) Shutdown() {
-	if l.cancel != nil {
+	l.ShutdownContext(context.Background())
+}
+
+// ShutdownContext ends the background processing of the loader, and waits
+// for the loads in progress to complete. Queued resources, including any
+// waiting for the Scheduler or to be retried, are no longer loaded: those
+// whose work the Scheduler runs regardless fail with ErrShutdown. If ctx is
+// done first, the loads in progress are cancelled and ShutdownContext waits
+// for them to return, before returning ctx.Err(). Loads that ignore the
+// cancellation of their context therefore delay ShutdownContext.
+//
+// The default Scheduler is shut down too, whereas a Scheduler provided by
+// the caller is left to the caller. Once ShutdownContext returns, the
+// channels returned by Updated, and by that of each FrameScope, are closed,
+// and the loader can no longer be used.
+func (l *Loader) ShutdownContext(ctx context.Context) error {
+	l.init.Do(l.initialize)
+	l.loader.mu.Lock()
+	l.loader.closing = true
+	if l.loader.dispatching != nil {
+		l.loader.dispatching()
+	}
+	for t := range l.loader.retries {
+		t.Stop()
+		delete(l.loader.retries, t)
+	}
+	l.loader.wake()
+	l.loader.mu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		// Loads only start while the loop is running.
+		<-l.loader.done
+		l.loader.working.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
 		l.cancel()
+		<-drained
+	}
+	l.cancel()
+	l.scopesMu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.updated)
+		for sc := range l.scopes {
+			close(sc.updated)
+		}
+	}
+	l.scopesMu.Unlock()
+	if l.pool != nil {
+		// The pool is idle now that the loads are done.
+		if perr := l.pool.Shutdown(ctx); err == nil {
+			err = perr
+		}
 	}
+	return err
 }
 
 // run the persistent processing goroutine that performs the blocking operations.
 func (l *Loader) run(ctx context.Context) {
-	go func() {
-		<-ctx.Done()
-		l.refresh.Signal()
-	}()
-	defer close(l.updated)
-
 	loader := &l.loader
+	defer close(loader.done)
 
 	loader.mu.Lock()
 	defer loader.mu.Unlock()
+	defer func() {
+		loader.stopped = true
+		loader.settled.Broadcast()
+	}()
 
-	firstIteration := true
 	for {
-		if !firstIteration {
-			// Wait to be woken up by a change. Three conditions which provoke this:
-			// 1. a new frame layout
-			// 2. scheduling a _new_ resource
-			// 3. context cancellation
-			// Each iteration synchronizes access to the map and queue.
+		// Wait to be woken up by a change. Three conditions which provoke this:
+		// 1. a new frame layout
+		// 2. scheduling a _new_ resource
+		// 3. shutting down
+		// Each iteration synchronizes access to the map and queue.
+		for !loader.dirty && !loader.closing {
+			loader.asleep = true
+			loader.settled.Broadcast()
 			loader.refresh.Wait()
-			if ctx.Err() != nil {
-				return
+			loader.asleep = false
+		}
+		if loader.closing {
+			return
+		}
+		loader.dirty = false
+		loader.purge(l.MaxLoaded)
+		// Stop loading resources that are no longer being laid out.
+		for r := range loader.loading {
+			if r.isOld() {
+				loader.evict(r)
 			}
 		}
-		firstIteration = false
-		loader.purge(atomic.LoadInt64(&l.finished), l.MaxLoaded)
-		for r := loader.next(); r != nil; r = loader.next() {
+		for r := loader.next(); r != nil && !loader.closing; r = loader.next() {
 			r := r
-			if l.isOld(r) {
-				loader.remove(r)
+			if r.isOld() || loader.lookup[r.tag] != r {
+				loader.evict(r)
 				continue
 			}
+			loader.loading[r] = struct{}{}
+			if f, ok := loader.flights[r.key]; ok {
+				// Share the load already in progress for the same key.
+				loader.join(f, r)
+				if f.started {
+					r.start()
+					r.Report(f.partial, f.progress)
+					l.update()
+				}
+				continue
+			}
+			f := loader.takeoff(ctx, r)
+			// Scheduling is abandoned once the load is no longer wanted, or
+			// once the loader shuts down.
+			sctx, scancel := context.WithCancel(f.ctx)
+			loader.dispatching = scancel
 			loader.mu.Unlock()
 			l.update()
-			l.Scheduler.Schedule(func() {
-				r.Load(ctx, func(_ State) {
+			report := ProgressFunc(func(partial interface{}, progress float32) {
+				loader.mu.Lock()
+				if partial != nil {
+					f.partial = partial
+				}
+				f.progress = progress
+				for m := range f.members {
+					m.Report(partial, progress)
+				}
+				loader.mu.Unlock()
+				l.update()
+			})
+			err := schedule(sctx, l.Scheduler, f.key, func() {
+				loader.mu.Lock()
+				if f.ctx.Err() != nil || loader.closing {
+					// Removed, or shut down, while waiting for a worker. The
+					// load never starts, so its resources fail, if any still
+					// await it.
+					members := loader.land(f)
+					loader.mu.Unlock()
+					for _, m := range members {
+						m.fail(ErrShutdown)
+					}
 					l.update()
-				})
+					return
+				}
+				loader.working.Add(1)
+				defer loader.working.Done()
+				f.started = true
+				for m := range f.members {
+					m.start()
+				}
+				loader.mu.Unlock()
+				l.update()
+				start := time.Now()
+				v, err := r.load(context.WithValue(f.ctx, progressKey{}, report))
+				elapsed := time.Since(start)
+				loader.mu.Lock()
+				if err != nil && f.ctx.Err() != nil {
+					// Cancelled rather than failed.
+					loader.counters.cancellations++
+				} else {
+					loader.counters.loads++
+					loader.counters.loadTime += elapsed
+					if err != nil {
+						loader.counters.failures++
+					}
+				}
+				members := loader.land(f)
+				loader.mu.Unlock()
+				for _, m := range members {
+					if err != nil {
+						m.fail(err)
+						l.retry(m)
+					} else {
+						m.Set(Loaded, v, nil)
+					}
+				}
+				l.update()
 			})
 			loader.mu.Lock()
+			loader.dispatching = nil
+			scancel()
+			if err != nil {
+				// The load never started, so its resources fail, if any
+				// still await it.
+				for _, m := range loader.land(f) {
+					m.fail(err)
+				}
+				l.update()
+			}
 		}
 	}
 }
 
-// isOld reports whether the resource is old.
-// Old is defined as being last used in a frame prior to the current frame.
-// For example, a resource is "old" if the last frame it was used was frame 3
-// and the current frame is frame 10.
-func (l *Loader) isOld(r *resource) bool {
-	return atomic.LoadInt64(&r.frame) < atomic.LoadInt64(&l.finished)
+// retry queues the failed resource to be loaded again after a delay, if the
+// retry policy allows it.
+func (l *Loader) retry(r *resource) {
+	r.Lock()
+	r.retries++
+	delay, ok := l.Retry.Delay(r.retries)
+	r.Unlock()
+	if !ok {
+		return
+	}
+	l.loader.mu.Lock()
+	defer l.loader.mu.Unlock()
+	if l.loader.closing {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		l.loader.mu.Lock()
+		defer l.loader.mu.Unlock()
+		delete(l.loader.retries, t)
+		// Resources that were purged in the meantime are no longer wanted.
+		if l.loader.closing || l.loader.lookup[r.tag] != r {
+			return
+		}
+		l.loader.enqueue(r)
+	})
+	l.loader.retries[t] = struct{}{}
+}
+
+// Invalidate the resource with the given tag, along with any other resource
+// sharing its key, and remove their value from the Cache. The next time they
+// are scheduled, they are loaded again from scratch.
+func (l *Loader) Invalidate(tag Tag) {
+	l.init.Do(l.initialize)
+	l.loader.mu.Lock()
+	defer l.loader.mu.Unlock()
+	key := tag
+	if r, ok := l.loader.lookup[tag]; ok {
+		key = r.key
+	}
+	l.loader.invalidate(l.Cache, func(r *resource) bool {
+		return r.key == key
+	})
+	l.Cache.Remove(key)
+	l.update()
+}
+
+// InvalidateFunc invalidates every resource whose tag matches, as if by
+// Invalidate. For example, to invalidate every resource with a string tag
+// beginning with a prefix:
+//
+//	loader.InvalidateFunc(func(tag async.Tag) bool {
+//		s, ok := tag.(string)
+//		return ok && strings.HasPrefix(s, prefix)
+//	})
+func (l *Loader) InvalidateFunc(match func(tag Tag) bool) {
+	l.init.Do(l.initialize)
+	l.loader.mu.Lock()
+	defer l.loader.mu.Unlock()
+	l.loader.invalidate(l.Cache, func(r *resource) bool {
+		return match(r.tag)
+	})
+	l.update()
 }
 
-// establish a resource for the given tag and load function.
-// If the resource does not already exist it is first allocated.
+// Refresh loads the resource with the given tag again, along with any other
+// resource sharing its key, bypassing the Cache. Unlike Invalidate, loaded
+// resources keep their current value until the new one is loaded. If the new
+// load fails, its error is reported alongside the current value, and it is
+// retried according to the Retry policy.
+func (l *Loader) Refresh(tag Tag) {
+	l.init.Do(l.initialize)
+	l.loader.mu.Lock()
+	defer l.loader.mu.Unlock()
+	r, ok := l.loader.lookup[tag]
+	if !ok {
+		return
+	}
+	l.Cache.Remove(r.key)
+	for _, other := range l.loader.lookup {
+		if other.key == r.key {
+			l.loader.reload(other)
+		}
+	}
+}
+
+// establish a resource for the given tag, key, and load function.
+// If the resource does not already exist it is first allocated, loading it
+// through the cache, if any.
 // A copy of the state and a reference to the value are returned.
-func (l *loader) establish(tag Tag, load LoadFunc, activeFrame int64) Resource {
+func (l *loader) establish(tag, key Tag, cache *Cache, load LoadErrFunc, priority Priority, sc *scope) Resource {
 	l.mu.Lock()
 	r, ok := l.lookup[tag]
 	if !ok {
 		r = &resource{
 			tag:   tag,
+			key:   key,
 			load:  load,
 			state: Queued,
 			value: nil,
 		}
+		if cache != nil {
+			r.load = func(ctx context.Context) (interface{}, error) {
+				return cache.load(ctx, key, load)
+			}
+		}
 		l.lookup[tag] = r
-		l.queue = append(l.queue, r)
-		l.refresh.Signal()
+		if v, ok := cache.Get(key); ok {
+			// Values cached in memory are available immediately.
+			r.state, r.value = Loaded, v
+			l.counters.hits++
+		} else {
+			l.enqueue(r)
+			l.counters.misses++
+		}
 	}
+	// Set the resource frame to that of the currently active frame of the
+	// scope. This "freshens" the resource, indicating that it has recently
+	// been accessed. It must happen before the loop next inspects the
+	// resource, lest it be considered old.
+	r.touch(sc)
+	atomic.StoreInt32(&r.priority, int32(priority))
 	l.mu.Unlock()
-	// Set the resource frame to that of the currently active frame.
-	// This "freshens" the resource, indicating that it has recently been
-	// accessed.
-	atomic.StoreInt64(&r.frame, activeFrame)
-	state, value := r.Get()
-	return Resource{
-		State: state,
-		Value: value,
+	return r.Get()
+}
+
+// enqueue r to be loaded, unless it already is.
+// Only call this when lock has been acquired.
+func (l *loader) enqueue(r *resource) {
+	if _, ok := l.loading[r]; ok || r.queued {
+		return
+	}
+	r.queued = true
+	l.queue = append(l.queue, r)
+	l.wake()
+}
+
+// invalidate removes the resources that match, along with their cached
+// values.
+// Only call this when lock has been acquired.
+func (l *loader) invalidate(cache *Cache, match func(r *resource) bool) {
+	for _, r := range l.lookup {
+		if match(r) {
+			l.remove(r)
+			cache.Remove(r.key)
+		}
+	}
+}
+
+// reload r, cancelling its current load, if any, while keeping its value.
+// Only call this when lock has been acquired.
+func (l *loader) reload(r *resource) {
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
 	}
+	delete(l.loading, r)
+	r.Lock()
+	r.refreshing = r.state == Loaded
+	r.retries = 0
+	r.Unlock()
+	l.enqueue(r)
+}
+
+// wake the loop to process the changes made to the loader.
+// Only call this when lock has been acquired.
+func (l *loader) wake() {
+	l.dirty = true
+	l.refresh.Signal()
 }
 
-// next selects the next resource off the queue.
+// next selects the next resource off the queue: the one touched during the
+// most recent frame with the highest priority, in the order they were queued.
 // Only call this when lock has been acquired.
 func (l *loader) next() *resource {
 	if len(l.queue) == 0 {
 		return nil
 	}
-	r := l.queue[0]
-	l.queue = l.queue[1:]
+	// Each recency is computed once, as doing so locks the resource.
+	var (
+		best     = 0
+		recency  = l.queue[0].recency()
+		priority = atomic.LoadInt32(&l.queue[0].priority)
+	)
+	for ii, r := range l.queue[1:] {
+		rr, rp := r.recency(), atomic.LoadInt32(&r.priority)
+		if rr > recency || (rr == recency && rp < priority) {
+			best, recency, priority = ii+1, rr, rp
+		}
+	}
+	r := l.queue[best]
+	l.queue = append(l.queue[:best], l.queue[best+1:]...)
+	r.queued = false
 	return r
 }
 
@@ -373,20 +1139,100 @@ func (l *loader) next() *resource {
 // been exhausted.
 //
 // Only call this when lock has been acquired.
-func (l *loader) purge(activeFrame int64, max int) {
+func (l *loader) purge(max int) {
 	for _, r := range l.lookup {
 		if len(l.lookup) < max {
 			break
 		}
-		if isOld := atomic.LoadInt64(&r.frame) < activeFrame; isOld {
-			l.remove(r)
+		if r.isOld() {
+			l.evict(r)
 		}
 	}
 }
 
+// flight is a load shared by the resources with the same key.
+// Access is synchronized by the loader mutex.
+type flight struct {
+	key Tag
+	// ctx of the load, cancelled once no resource awaits it.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// started reports whether a worker has started the load.
+	started bool
+	// partial is the most recent partial value reported by the load, and
+	// progress its most recent progress.
+	partial  interface{}
+	progress float32
+	// members are the resources awaiting the result of the load.
+	members map[*resource]struct{}
+}
+
+// takeoff starts a flight to load the value of r.
+// Only call this when lock has been acquired.
+func (l *loader) takeoff(ctx context.Context, r *resource) *flight {
+	f := &flight{
+		key:     r.key,
+		members: make(map[*resource]struct{}),
+	}
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	l.flights[r.key] = f
+	l.join(f, r)
+	return f
+}
+
+// join adds r to the resources awaiting the result of f.
+// Only call this when lock has been acquired.
+func (l *loader) join(f *flight, r *resource) {
+	f.members[r] = struct{}{}
+	r.cancel = func() {
+		delete(f.members, r)
+		if len(f.members) == 0 {
+			// Nothing awaits the load any longer.
+			l.land(f)
+		}
+	}
+}
+
+// land ends f, returning the resources that were awaiting its result.
+// Only call this when lock has been acquired.
+func (l *loader) land(f *flight) []*resource {
+	f.cancel()
+	if l.flights[f.key] == f {
+		delete(l.flights, f.key)
+	}
+	members := make([]*resource, 0, len(f.members))
+	for r := range f.members {
+		members = append(members, r)
+		delete(l.loading, r)
+		r.cancel = nil
+	}
+	f.members = nil
+	return members
+}
+
 // remove the resource from the local storage and let it be garbage collected.
+// Any load of the resource in progress is cancelled, unless it is shared
+// with other resources.
+//
+// Only call this when lock has been acquired.
 func (l *loader) remove(r *resource) {
-	delete(l.lookup, r.tag)
+	if l.lookup[r.tag] == r {
+		delete(l.lookup, r.tag)
+	}
+	delete(l.loading, r)
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
+
+// evict the resource because it is no longer being laid out.
+// Only call this when lock has been acquired.
+func (l *loader) evict(r *resource) {
+	if l.lookup[r.tag] == r {
+		l.counters.evictions++
+	}
+	l.remove(r)
 }
 
 // resource records data about a loading value.
@@ -394,15 +1240,35 @@ func (l *loader) remove(r *resource) {
 // during allocation, and frame is synchronized via atomic operations.
 type resource struct {
 	sync.Mutex
-	// frame wherein this data is valid.
+	// frames maps the scopes that have scheduled the resource to the most
+	// recent frame of each wherein this data is valid.
+	// Access is synchronized by mutex.
+	frames map[*scope]int64
+	// priority of the resource, as of the last time it was scheduled.
 	// Access must be synchronized with atomics.
-	frame int64
+	priority int32
 	// state of the resource for this frame.
 	// Access is synchronized by mutex, use Get method.
 	state State
 	// value for the resource, if acquired.
 	// Access is synchronized by mutex, use Get method.
 	value interface{}
+	// progress reported by the current load.
+	// Access is synchronized by mutex, use Get method.
+	progress float32
+	// err returned by the most recent load, if it failed.
+	// Access is synchronized by mutex, use Get method.
+	err error
+	// retries counts the retries of failed loads.
+	// Access is synchronized by mutex.
+	retries int
+	// refreshing reports whether the resource is being loaded again while
+	// keeping its current value.
+	// Access is synchronized by mutex.
+	refreshing bool
+	// queued reports whether the resource is in the queue.
+	// Access is synchronized by the loader mutex.
+	queued bool
 	// tag of the resource.
 	// Used to uniquely identify the resource stored in a map.
 	// Must be a hashable value.
@@ -412,31 +1278,115 @@ type resource struct {
 	// Used to perform the blocking load of the value, like a network call or
 	// disk operation.
 	// Unsynchronized field, do not modify.
-	load LoadFunc
+	load LoadErrFunc
+	// key identifying the underlying value of the resource.
+	// Unsynchronized field, do not modify.
+	key Tag
+	// cancel the current load of the resource, if any.
+	// Access is synchronized by the loader mutex.
+	cancel func()
 }
 
-// Load the value for the resource using the configured closure.
-// State changes occur during load sequence, invoking onChange callback per
-// state change.
-func (r *resource) Load(ctx context.Context, onChange func(State)) {
-	r.Set(Loading, nil)
-	onChange(r.state)
-	v := r.load(ctx)
-	r.Set(Loaded, v)
-	onChange(r.state)
+// touch records that the resource is scheduled during the active frame of
+// sc.
+func (r *resource) touch(sc *scope) {
+	r.Lock()
+	defer r.Unlock()
+	if r.frames == nil {
+		r.frames = make(map[*scope]int64, 1)
+	}
+	r.frames[sc] = atomic.LoadInt64(&sc.active)
 }
 
-// Get the state and value for the resource.
-func (r *resource) Get() (State, interface{}) {
+// recency of the resource: the most recent of the frames wherein it was
+// scheduled, relative to the scope of each (see scope.recency).
+func (r *resource) recency() int64 {
 	r.Lock()
 	defer r.Unlock()
-	return r.state, r.value
+	recency := int64(math.MinInt64)
+	for sc, frame := range r.frames {
+		if sc.isClosed() {
+			delete(r.frames, sc)
+			continue
+		}
+		if rec := sc.recency(frame); rec > recency {
+			recency = rec
+		}
+	}
+	return recency
+}
+
+// isOld reports whether the resource is old.
+// Old is defined as being last used in a frame prior to the current frame of
+// every scope that used it. For example, a resource is "old" if the last
+// frame it was used was frame 3 and the current frame is frame 10.
+func (r *resource) isOld() bool {
+	return r.recency() < 0
+}
+
+// Get a copy of the state of the resource.
+func (r *resource) Get() Resource {
+	r.Lock()
+	defer r.Unlock()
+	return Resource{
+		State:    r.state,
+		Value:    r.value,
+		Progress: r.progress,
+		Err:      r.err,
+	}
 }
 
-// Set the state and value for the resource.
-func (r *resource) Set(s State, v interface{}) {
+// Set the state, value, and error for the resource, resetting its progress.
+func (r *resource) Set(s State, v interface{}, err error) {
 	r.Lock()
+	defer r.Unlock()
+	r.set(s, v, err)
+}
+
+// set is Set for callers holding the mutex.
+func (r *resource) set(s State, v interface{}, err error) {
 	r.state = s
 	r.value = v
-	r.Unlock()
+	r.err = err
+	r.progress = 0
+	if s == Loaded {
+		r.progress = 1
+	}
+	r.refreshing = false
+}
+
+// start marks the resource as Loading, unless it is being refreshed, in which
+// case its current value remains.
+func (r *resource) start() {
+	r.Lock()
+	defer r.Unlock()
+	if !r.refreshing {
+		r.set(Loading, nil, nil)
+	}
+}
+
+// fail marks the resource as Failed with err, unless it is being refreshed,
+// in which case err is reported alongside its current value.
+func (r *resource) fail(err error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.refreshing {
+		r.err = err
+		return
+	}
+	r.set(Failed, nil, err)
+}
+
+// Report a partial value and the progress of the load of the resource.
+// Reports are ignored unless the resource is Loading.
+func (r *resource) Report(partial interface{}, progress float32) {
+	r.Lock()
+	defer r.Unlock()
+	if r.state != Loading {
+		return
+	}
+	if partial != nil {
+		r.value = partial
+	}
+	r.progress = float32(math.Max(0, math.Min(float64(progress), 1)))
 }
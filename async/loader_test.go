@@ -0,0 +1,727 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestLoader returns a loader driven by a ManualScheduler.
+func newTestLoader(t *testing.T) (*TypedLoader[string, int], *ManualScheduler) {
+	s := &ManualScheduler{}
+	l := &TypedLoader[string, int]{Loader: Loader{Scheduler: s}}
+	t.Cleanup(func() {
+		l.Shutdown()
+	})
+	return l, s
+}
+
+// constant returns a load function that counts its invocations in calls.
+func constant(v int, calls *int) TypedLoadFunc[int] {
+	return func(context.Context) int {
+		*calls++
+		return v
+	}
+}
+
+// TestLoaderStates ensures that a resource moves from Queued to Loaded once
+// its load has run.
+func TestLoaderStates(t *testing.T) {
+	l, s := newTestLoader(t)
+	var calls int
+	var r TypedResource[int]
+	l.Step(func() {
+		r = l.Schedule("a", constant(42, &calls))
+	})
+	if r.State != Queued {
+		t.Errorf("expected Queued before loading, got %v", r.State)
+	}
+	l.Sync()
+	if n := s.RunPending(); n != 1 {
+		t.Errorf("expected 1 load to be scheduled, got %d", n)
+	}
+	l.Step(func() {
+		r = l.Schedule("a", constant(42, &calls))
+	})
+	if r.State != Loaded || r.Value != 42 || r.Progress != 1 {
+		t.Errorf("expected Loaded 42 with full progress, got %+v", r)
+	}
+	l.Sync()
+	if n := s.Pending(); n != 0 || calls != 1 {
+		t.Errorf("expected a single load, got %d calls and %d pending", calls, n)
+	}
+}
+
+// TestLoaderPriority ensures that visible resources are loaded before
+// prefetched ones, in the order they were scheduled.
+func TestLoaderPriority(t *testing.T) {
+	l, s := newTestLoader(t)
+	var order []string
+	load := func(tag string) TypedLoadFunc[int] {
+		return func(context.Context) int {
+			order = append(order, tag)
+			return 0
+		}
+	}
+	l.Step(func() {
+		l.Schedule("p1", load("p1"), WithPriority(Prefetch))
+		l.Schedule("v1", load("v1"))
+		l.Schedule("p2", load("p2"), WithPriority(Prefetch))
+		l.Schedule("v2", load("v2"))
+	})
+	l.Sync()
+	s.RunPending()
+	if want := []string{"v1", "v2", "p1", "p2"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("expected loads in order %v, got %v", want, order)
+	}
+}
+
+// TestLoaderNext ensures that the queue yields the resources touched during
+// the most recent frame first, then by priority, then in the order they were
+// queued.
+func TestLoaderNext(t *testing.T) {
+	sc := &scope{active: 3, finished: 2}
+	l := loader{}
+	queue := func(tag string, frame int64, p Priority) {
+		r := &resource{tag: tag, priority: int32(p)}
+		r.frames = map[*scope]int64{sc: frame}
+		l.queue = append(l.queue, r)
+		r.queued = true
+	}
+	queue("old", 1, Visible)
+	queue("finished-prefetch", 2, Prefetch)
+	queue("finished", 2, Visible)
+	queue("active-prefetch", 3, Prefetch)
+	queue("active", 3, Visible)
+	queue("active-2", 3, Visible)
+	var order []Tag
+	for r := l.next(); r != nil; r = l.next() {
+		if r.queued {
+			t.Errorf("expected %v to be marked as no longer queued", r.tag)
+		}
+		order = append(order, r.tag)
+	}
+	want := []Tag{"active", "active-2", "active-prefetch", "finished", "finished-prefetch", "old"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("expected resources in order %v, got %v", want, order)
+	}
+}
+
+// TestLoaderStale ensures that resources which stop being scheduled before
+// their load starts are never loaded.
+func TestLoaderStale(t *testing.T) {
+	l, s := newTestLoader(t)
+	var calls int
+	l.Step(func() {
+		l.Schedule("a", constant(1, &calls))
+	})
+	l.Sync()
+	l.Step(func() {})
+	l.Sync()
+	s.RunPending()
+	if calls != 0 {
+		t.Errorf("expected the stale resource not to load, got %d calls", calls)
+	}
+	if stats := l.Stats(); stats.Lookup != 0 {
+		t.Errorf("expected the stale resource to be removed, got %+v", stats)
+	}
+}
+
+// TestLoaderStaleInFlight ensures that the load of a resource which stops
+// being scheduled is cancelled, unless another resource still awaits it.
+func TestLoaderStaleInFlight(t *testing.T) {
+	l, s := newTestLoader(t)
+	started := make(chan struct{}, 2)
+	cancelled := make(chan string, 2)
+	load := func(tag string) TypedLoadFunc[int] {
+		return func(ctx context.Context) int {
+			started <- struct{}{}
+			select {
+			case <-ctx.Done():
+				cancelled <- tag
+			case <-time.After(50 * time.Millisecond):
+			}
+			return 0
+		}
+	}
+	l.Step(func() {
+		l.Schedule("stale", load("stale"))
+		l.Schedule("a", load("shared"), WithKey("k"))
+		l.Schedule("b", load("shared"), WithKey("k"))
+	})
+	l.Sync()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunPending()
+	}()
+	<-started
+	// Only "b" remains scheduled, which keeps the shared load alive.
+	l.Step(func() {
+		l.Schedule("b", load("shared"), WithKey("k"))
+	})
+	l.Sync()
+	<-done
+	close(cancelled)
+	var got []string
+	for tag := range cancelled {
+		got = append(got, tag)
+	}
+	if want := []string{"stale"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the loads of %v to be cancelled, got %v", want, got)
+	}
+	if stats := l.Stats(); stats.Lookup != 1 || stats.Evictions != 2 {
+		t.Errorf("expected the stale resources to be evicted, got %+v", stats)
+	}
+}
+
+// TestLoaderSharedKey ensures that resources with the same key share a load.
+func TestLoaderSharedKey(t *testing.T) {
+	l, s := newTestLoader(t)
+	var calls int
+	var a, b TypedResource[int]
+	frame := func() {
+		l.Step(func() {
+			a = l.Schedule("a", constant(7, &calls), WithKey("k"))
+			b = l.Schedule("b", constant(7, &calls), WithKey("k"))
+		})
+		l.Sync()
+	}
+	frame()
+	s.RunPending()
+	frame()
+	if a.State != Loaded || b.State != Loaded || a.Value != 7 || b.Value != 7 {
+		t.Errorf("expected both resources Loaded with 7, got %+v and %+v", a, b)
+	}
+	if calls != 1 {
+		t.Errorf("expected a single load, got %d", calls)
+	}
+}
+
+// TestLoaderSharedKeyJoin ensures that a resource joining a load that is
+// already in progress reports its partial value, and receives its result.
+func TestLoaderSharedKeyJoin(t *testing.T) {
+	l, s := newTestLoader(t)
+	reported, release := make(chan struct{}), make(chan struct{})
+	var calls int32
+	load := func(ctx context.Context) int {
+		atomic.AddInt32(&calls, 1)
+		Progress(ctx)(1, 0.5)
+		close(reported)
+		<-release
+		return 2
+	}
+	l.Step(func() {
+		l.Schedule("a", load, WithKey("k"))
+	})
+	l.Sync()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunPending()
+	}()
+	<-reported
+	var b TypedResource[int]
+	frame := func() {
+		l.Step(func() {
+			l.Schedule("a", load, WithKey("k"))
+			b = l.Schedule("b", load, WithKey("k"))
+		})
+		l.Sync()
+	}
+	frame()
+	frame()
+	if b.State != Loading || b.Value != 1 || b.Progress != 0.5 {
+		t.Errorf("expected b to join the load at half progress, got %+v", b)
+	}
+	close(release)
+	<-done
+	frame()
+	if b.State != Loaded || b.Value != 2 {
+		t.Errorf("expected b Loaded with 2, got %+v", b)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 || s.Pending() != 0 {
+		t.Errorf("expected a single load, got %d calls and %d pending", n, s.Pending())
+	}
+}
+
+// TestLoaderFailure ensures that failed loads report their error.
+func TestLoaderFailure(t *testing.T) {
+	l, s := newTestLoader(t)
+	failure := errors.New("failure")
+	var r TypedResource[int]
+	frame := func() {
+		l.Step(func() {
+			r = l.ScheduleErr("a", func(context.Context) (int, error) {
+				return 0, failure
+			})
+		})
+		l.Sync()
+	}
+	frame()
+	s.RunPending()
+	frame()
+	if r.State != Failed || !errors.Is(r.Err, failure) {
+		t.Errorf("expected Failed with %v, got %+v", failure, r)
+	}
+	if n := s.Pending(); n != 0 {
+		t.Errorf("expected no retry without a RetryPolicy, got %d pending", n)
+	}
+}
+
+// TestRetryPolicyDelay ensures that the delay between retries grows
+// exponentially up to MaxBackoff, and that jitter only ever shortens it.
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxRetries: 5, Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for retry, want := range map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		4: 50 * time.Millisecond,
+		5: 50 * time.Millisecond,
+	} {
+		if got, ok := p.Delay(retry); !ok || got != want {
+			t.Errorf("retry %d: expected a delay of %v, got %v (%v)", retry, want, got, ok)
+		}
+	}
+	for _, retry := range []int{0, 6} {
+		if _, ok := p.Delay(retry); ok {
+			t.Errorf("retry %d: expected no retry", retry)
+		}
+	}
+	p.Multiplier = 3
+	if got, _ := p.Delay(2); got != 30*time.Millisecond {
+		t.Errorf("expected a delay of 30ms with a multiplier of 3, got %v", got)
+	}
+	p.Multiplier = 0
+	for _, jitter := range []float64{0.5, 2} {
+		p.Jitter = jitter
+		min := time.Duration(float64(40*time.Millisecond) * (1 - math.Min(jitter, 1)))
+		for ii := 0; ii < 100; ii++ {
+			if got, _ := p.Delay(3); got < min || got > 40*time.Millisecond {
+				t.Fatalf("jitter %v: expected a delay within [%v, 40ms], got %v", jitter, min, got)
+			}
+		}
+	}
+}
+
+// TestLoaderRetry ensures that failed loads are retried according to the
+// RetryPolicy, until they succeed.
+func TestLoaderRetry(t *testing.T) {
+	l, s := newTestLoader(t)
+	l.Retry = RetryPolicy{MaxRetries: 3, Backoff: time.Millisecond}
+	failure := errors.New("failure")
+	var calls int
+	load := func(context.Context) (int, error) {
+		calls++
+		if calls < 3 {
+			return 0, failure
+		}
+		return 3, nil
+	}
+	var r TypedResource[int]
+	for deadline := time.Now().Add(time.Second); r.State != Loaded && time.Now().Before(deadline); {
+		l.Step(func() {
+			r = l.ScheduleErr("a", load)
+		})
+		l.Sync()
+		s.RunPending()
+		time.Sleep(time.Millisecond)
+	}
+	if r.State != Loaded || r.Value != 3 || r.Err != nil {
+		t.Errorf("expected Loaded 3 after retrying, got %+v", r)
+	}
+	if calls != 3 {
+		t.Errorf("expected 2 retries, got %d calls", calls)
+	}
+}
+
+// TestLoaderProgress ensures that partial values and progress reported by a
+// load are visible while it is Loading.
+func TestLoaderProgress(t *testing.T) {
+	l, s := newTestLoader(t)
+	var partial TypedResource[int]
+	var load TypedLoadFunc[int]
+	load = func(ctx context.Context) int {
+		Progress(ctx)(1, 0.5)
+		partial = l.Schedule("a", load)
+		return 2
+	}
+	l.Step(func() {
+		l.Schedule("a", load)
+	})
+	l.Sync()
+	s.RunPending()
+	if partial.State != Loading || partial.Value != 1 || partial.Progress != 0.5 {
+		t.Errorf("expected Loading 1 at half progress, got %+v", partial)
+	}
+	r := l.Schedule("a", load)
+	if r.State != Loaded || r.Value != 2 || r.Progress != 1 {
+		t.Errorf("expected Loaded 2 with full progress, got %+v", r)
+	}
+}
+
+// TestLoaderProgressReports ensures that reported progress is clamped, that a
+// nil partial value keeps the previous one, and that loads running outside of
+// a Loader can report progress.
+func TestLoaderProgressReports(t *testing.T) {
+	Progress(context.Background())(1, 0.5)
+	l, s := newTestLoader(t)
+	var reports []TypedResource[int]
+	var load TypedLoadFunc[int]
+	load = func(ctx context.Context) int {
+		for _, report := range []struct {
+			partial  interface{}
+			progress float32
+		}{
+			{partial: 1, progress: -1},
+			{partial: nil, progress: 0.25},
+			{partial: 3, progress: 2},
+		} {
+			Progress(ctx)(report.partial, report.progress)
+			reports = append(reports, l.Schedule("a", load))
+		}
+		return 4
+	}
+	l.Step(func() {
+		l.Schedule("a", load)
+	})
+	l.Sync()
+	// Drain the updates of scheduling the resource.
+	select {
+	case <-l.Updated():
+	default:
+	}
+	s.RunPending()
+	want := []TypedResource[int]{
+		{State: Loading, Value: 1, Progress: 0},
+		{State: Loading, Value: 1, Progress: 0.25},
+		{State: Loading, Value: 3, Progress: 1},
+	}
+	if !reflect.DeepEqual(reports, want) {
+		t.Errorf("expected reports %+v, got %+v", want, reports)
+	}
+	select {
+	case <-l.Updated():
+	default:
+		t.Errorf("expected the reports to be signalled on the Updated channel")
+	}
+}
+
+// TestLoaderUntyped ensures that the untyped Loader accepts tags of any
+// hashable type, and that values of another type than that of a TypedLoader
+// are reported as the zero value.
+func TestLoaderUntyped(t *testing.T) {
+	s := &ManualScheduler{}
+	l := &Loader{Scheduler: s}
+	defer l.Shutdown()
+	type key struct{ id int }
+	frame := func() (a, b Resource) {
+		l.Step(func() {
+			a = l.Schedule(key{1}, func(context.Context) interface{} { return "a" })
+			b = l.Schedule(2, func(context.Context) interface{} { return 2.0 })
+		})
+		l.Sync()
+		return a, b
+	}
+	frame()
+	s.RunPending()
+	a, b := frame()
+	if a.State != Loaded || a.Value != "a" || b.State != Loaded || b.Value != 2.0 {
+		t.Errorf("expected Loaded a and 2.0, got %+v and %+v", a, b)
+	}
+	if r := typed[int](Resource{State: Loading, Value: "partial"}); r.State != Loading || r.Value != 0 {
+		t.Errorf("expected a value of another type to be reported as zero, got %+v", r)
+	}
+}
+
+// TestLoaderInvalidate ensures that invalidated resources are loaded again
+// from scratch, bypassing the Cache.
+func TestLoaderInvalidate(t *testing.T) {
+	l, s := newTestLoader(t)
+	l.Cache = &Cache{}
+	var calls int
+	var r TypedResource[int]
+	frame := func(tag string) {
+		l.Step(func() {
+			r = l.Schedule(tag, constant(calls+1, &calls))
+		})
+		l.Sync()
+		s.RunPending()
+	}
+	frame("a")
+	frame("a")
+	if r.State != Loaded || r.Value != 1 {
+		t.Fatalf("expected Loaded 1, got %+v", r)
+	}
+	l.Invalidate("a")
+	frame("a")
+	if r.State != Queued {
+		t.Errorf("expected an invalidated resource to be Queued, got %+v", r)
+	}
+	frame("a")
+	if r.State != Loaded || r.Value != 2 || calls != 2 {
+		t.Errorf("expected Loaded 2 after 2 calls, got %+v after %d calls", r, calls)
+	}
+}
+
+// TestLoaderInvalidateFunc ensures that only the matching resources are
+// invalidated, skipping those with tags of another type.
+func TestLoaderInvalidateFunc(t *testing.T) {
+	l, s := newTestLoader(t)
+	var calls int
+	tags := []string{"avatar/a", "avatar/b", "image/a"}
+	frame := func() {
+		l.Step(func() {
+			for _, tag := range tags {
+				l.Schedule(tag, constant(0, &calls))
+			}
+			l.Loader.Schedule(42, func(context.Context) interface{} {
+				calls++
+				return 0
+			})
+		})
+		l.Sync()
+		s.RunPending()
+	}
+	frame()
+	l.InvalidateFunc(func(tag string) bool {
+		return strings.HasPrefix(tag, "avatar/")
+	})
+	frame()
+	if calls != 6 {
+		t.Errorf("expected the 2 invalidated resources to load again, got %d calls", calls)
+	}
+}
+
+// TestLoaderRefresh ensures that refreshed resources keep their value until
+// the new one is loaded.
+func TestLoaderRefresh(t *testing.T) {
+	l, s := newTestLoader(t)
+	l.Cache = &Cache{}
+	var calls int
+	load := func(context.Context) int {
+		calls++
+		return calls
+	}
+	var r TypedResource[int]
+	frame := func() {
+		l.Step(func() {
+			r = l.Schedule("a", load)
+		})
+		l.Sync()
+	}
+	frame()
+	s.RunPending()
+	frame()
+	l.Refresh("a")
+	frame()
+	if r.State != Loaded || r.Value != 1 {
+		t.Errorf("expected the old value while refreshing, got %+v", r)
+	}
+	if n := s.RunPending(); n != 1 {
+		t.Errorf("expected the refresh to be scheduled, got %d pending", n)
+	}
+	frame()
+	if r.State != Loaded || r.Value != 2 {
+		t.Errorf("expected Loaded 2 once refreshed, got %+v", r)
+	}
+}
+
+// TestLoaderStats ensures that the stats account for cache hits and misses,
+// completed and failed loads, and evictions.
+func TestLoaderStats(t *testing.T) {
+	l, s := newTestLoader(t)
+	l.MaxLoaded = 1
+	l.Cache = &Cache{}
+	l.Cache.Put("cached", 1)
+	var calls int
+	l.Step(func() {
+		l.Schedule("cached", constant(1, &calls))
+		l.Schedule("a", constant(2, &calls))
+		l.ScheduleErr("b", func(context.Context) (int, error) {
+			return 0, errors.New("failure")
+		})
+	})
+	l.Sync()
+	if stats := l.Stats(); stats.InFlight != 2 || stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("expected 1 hit and 2 misses in flight, got %+v", stats)
+	}
+	s.RunPending()
+	stats := l.Stats()
+	if stats.InFlight != 0 || stats.Loads != 2 || stats.Failures != 1 {
+		t.Errorf("expected 2 loads, 1 of which failed, got %+v", stats)
+	}
+	if ratio := stats.HitRatio(); ratio < 0.33 || ratio > 0.34 {
+		t.Errorf("expected a third of the resources to hit the cache, got %v", ratio)
+	}
+	l.Step(func() {})
+	l.Sync()
+	if stats := l.Stats(); stats.Lookup != 0 || stats.Evictions != 3 {
+		t.Errorf("expected the 3 resources to be evicted, got %+v", stats)
+	}
+}
+
+// TestLoaderStatsCancelled ensures that loads cancelled because their
+// resource went stale are not counted as failures.
+func TestLoaderStatsCancelled(t *testing.T) {
+	l := &TypedLoader[string, int]{}
+	started := make(chan struct{})
+	l.Step(func() {
+		l.ScheduleErr("a", func(ctx context.Context) (int, error) {
+			close(started)
+			<-ctx.Done()
+			return 0, ctx.Err()
+		})
+	})
+	<-started
+	// Evicting the resource cancels its load.
+	l.Step(func() {})
+	l.Sync()
+	// Shutdown waits for the load to return.
+	l.Shutdown()
+	if stats := l.Stats(); stats.Loads != 0 || stats.Failures != 0 || stats.Cancellations != 1 {
+		t.Errorf("expected 1 cancelled load, got %+v", stats)
+	}
+}
+
+// TestLoaderShutdown ensures that ShutdownContext waits for the loads in
+// progress to complete, or cancels them once its context is done, and that it
+// stops pending retries and closes the channels of scopes.
+func TestLoaderShutdown(t *testing.T) {
+	t.Run("drain", func(t *testing.T) {
+		l := &TypedLoader[string, int]{}
+		started, release := make(chan struct{}), make(chan struct{})
+		l.Step(func() {
+			l.Schedule("a", func(context.Context) int {
+				close(started)
+				<-release
+				return 1
+			})
+		})
+		<-started
+		done := make(chan error)
+		go func() {
+			done <- l.ShutdownContext(context.Background())
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("expected ShutdownContext to wait for the load, got %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(release)
+		if err := <-done; err != nil {
+			t.Errorf("expected ShutdownContext to succeed, got %v", err)
+		}
+		// The Updated channel is closed once any pending update is taken.
+		for range l.Updated() {
+		}
+	})
+	t.Run("abort", func(t *testing.T) {
+		l := &TypedLoader[string, int]{}
+		started := make(chan struct{})
+		var cancelled bool
+		l.Step(func() {
+			l.Schedule("a", func(ctx context.Context) int {
+				close(started)
+				<-ctx.Done()
+				cancelled = true
+				return 0
+			})
+		})
+		<-started
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := l.ShutdownContext(ctx); err != context.Canceled {
+			t.Errorf("expected ShutdownContext to report the cancellation, got %v", err)
+		}
+		if !cancelled {
+			t.Errorf("expected ShutdownContext to wait for the cancelled load to return")
+		}
+	})
+	t.Run("retries", func(t *testing.T) {
+		l, s := newTestLoader(t)
+		l.Retry = RetryPolicy{MaxRetries: 1, Backoff: time.Hour}
+		l.Step(func() {
+			l.ScheduleErr("a", func(context.Context) (int, error) {
+				return 0, errors.New("failure")
+			})
+		})
+		l.Sync()
+		s.RunPending()
+		l.loader.mu.Lock()
+		pending := len(l.loader.retries)
+		l.loader.mu.Unlock()
+		if pending != 1 {
+			t.Fatalf("expected a retry to be pending, got %d", pending)
+		}
+		l.Shutdown()
+		if n := len(l.loader.retries); n != 0 {
+			t.Errorf("expected the pending retry to be stopped, got %d", n)
+		}
+	})
+	t.Run("scopes", func(t *testing.T) {
+		l, _ := newTestLoader(t)
+		sc := l.NewScope()
+		l.Shutdown()
+		for _, updated := range []<-chan struct{}{sc.Updated(), l.NewScope().Updated()} {
+			select {
+			case _, ok := <-updated:
+				if ok {
+					// Drain the pending update.
+					_, ok = <-updated
+				}
+				if ok {
+					t.Errorf("expected the channel of the scope to be closed")
+				}
+			case <-time.After(time.Second):
+				t.Errorf("expected the channel of the scope to be closed")
+			}
+		}
+	})
+}
+
+// TestWorkerPoolCancel ensures that the worker pools stop blocking once the
+// context of the work is done, or once they are shut down.
+func TestWorkerPoolCancel(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		pool interface {
+			Scheduler
+			Shutdown(context.Context) error
+		}
+	}{
+		{name: "fixed", pool: &FixedWorkerPool{Workers: 1}},
+		{name: "dynamic", pool: &DynamicWorkerPool{Workers: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			if err := tc.pool.Schedule(context.Background(), func() { <-release }); err != nil {
+				t.Fatalf("scheduling: %v", err)
+			}
+			// The dynamic pool accepts one more piece of work while waiting
+			// for a worker, so saturate it until scheduling blocks.
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			var err error
+			for ii := 0; ii < 3 && err == nil; ii++ {
+				err = tc.pool.Schedule(ctx, func() {})
+			}
+			if err != context.DeadlineExceeded {
+				t.Errorf("expected the saturated pool to time out, got %v", err)
+			}
+			close(release)
+			if err := tc.pool.Shutdown(context.Background()); err != nil {
+				t.Errorf("shutting down: %v", err)
+			}
+			if err := tc.pool.Schedule(context.Background(), func() {}); err != ErrShutdown {
+				t.Errorf("expected scheduling to fail after shutdown, got %v", err)
+			}
+		})
+	}
+}
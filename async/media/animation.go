@@ -0,0 +1,475 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"time"
+
+	"gioui.org/op/paint"
+	"git.sr.ht/~gioverse/chat/async"
+)
+
+// Animation is a decoded animated image, with each of its frames ready to be
+// laid out.
+type Animation struct {
+	// Frames of the animation, fully composited.
+	Frames []paint.ImageOp
+	// Delays holds the time each frame is displayed for.
+	Delays []time.Duration
+	// Plays is the number of times the animation plays. Zero plays forever.
+	Plays int
+}
+
+// MinDelay is the shortest time a frame of an Animation is displayed for.
+// Shorter delays, including none at all, are commonly used by images that
+// expect the frame rate to be limited, so they are replaced with DefaultDelay.
+const MinDelay = 20 * time.Millisecond
+
+// DefaultDelay is the time a frame is displayed for when it specifies less
+// than MinDelay.
+const DefaultDelay = 100 * time.Millisecond
+
+// Duration of a single play of the animation.
+func (a *Animation) Duration() time.Duration {
+	var d time.Duration
+	for _, delay := range a.Delays {
+		d += delay
+	}
+	return d
+}
+
+// FrameAt returns the index of the frame displayed once the animation has
+// played for elapsed, and the time remaining until the next frame. The
+// remaining time is zero once the animation is over.
+func (a *Animation) FrameAt(elapsed time.Duration) (int, time.Duration) {
+	if len(a.Frames) < 2 {
+		return 0, 0
+	}
+	duration := a.Duration()
+	if a.Plays > 0 && elapsed >= duration*time.Duration(a.Plays) {
+		return len(a.Frames) - 1, 0
+	}
+	elapsed %= duration
+	for ii, delay := range a.Delays {
+		if elapsed < delay {
+			return ii, delay - elapsed
+		}
+		elapsed -= delay
+	}
+	return len(a.Frames) - 1, a.Delays[len(a.Delays)-1]
+}
+
+// SizeHint implements async.SizeHint.
+func (a *Animation) SizeHint() int64 {
+	var size int64
+	for _, f := range a.Frames {
+		sz := f.Size()
+		size += int64(sz.X) * int64(sz.Y) * 4
+	}
+	return size
+}
+
+// AnimationLoader loads animated images asynchronously, decoding all of their
+// frames.
+type AnimationLoader struct {
+	async.Loader
+}
+
+// Schedule the animated image to be loaded, like Loader.Schedule.
+func (l *AnimationLoader) Schedule(tag async.Tag, img Image, opts ...async.ScheduleOption) async.TypedResource[*Animation] {
+	r := l.Loader.ScheduleErr(tag, func(ctx context.Context) (interface{}, error) {
+		anim, err := LoadAnimation(ctx, img.Source, img.Size)
+		if err != nil {
+			return nil, err
+		}
+		return anim, nil
+	}, withKey(tag, img, opts)...)
+	return typed[*Animation](r)
+}
+
+// LoadAnimation loads and decodes the animated image from src, scaling its
+// frames down to fit size.
+func LoadAnimation(ctx context.Context, src Source, size image.Point) (*Animation, error) {
+	r, err := src(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	defer r.Close()
+	a, err := DecodeAnimation(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// DecodeAnimation decodes an animated GIF or PNG (APNG) from r, scaling its
+// frames down to fit size. Images that are not animated are decoded into a
+// single frame. Images larger than MaxPixels, or with more frames than fit
+// MaxPixels in total, are rejected with ErrTooLarge.
+func DecodeAnimation(r io.Reader, size image.Point) (*Animation, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading image: %w", err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	if err := checkSize(cfg); err != nil {
+		return nil, err
+	}
+	var c *canvas
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		c, err = decodeGIF(data, size)
+	case bytes.HasPrefix(data, pngSignature):
+		c, err = decodeAPNG(data, size)
+	default:
+		c, err = decodeStatic(data, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.animation(), nil
+}
+
+// checkFrames reports ErrTooLarge for animations whose frames, each
+// composited on a canvas of the given bounds, exceed MaxPixels in total.
+func checkFrames(bounds image.Rectangle, frames int) error {
+	if int64(bounds.Dx())*int64(bounds.Dy())*int64(frames) > MaxPixels {
+		return fmt.Errorf("decoding animation: %w: %d frames of %dx%d",
+			ErrTooLarge, frames, bounds.Dx(), bounds.Dy())
+	}
+	return nil
+}
+
+// canvas composites the frames of an animation.
+type canvas struct {
+	*image.RGBA
+	// size the frames are scaled down to fit.
+	size image.Point
+	// frames emitted so far, and their delays.
+	frames []*image.RGBA
+	delays []time.Duration
+	// plays is the number of times the animation plays.
+	plays int
+}
+
+func newCanvas(bounds image.Rectangle, size image.Point, plays int) *canvas {
+	return &canvas{
+		RGBA:  image.NewRGBA(bounds),
+		size:  size,
+		plays: plays,
+	}
+}
+
+// decodeStatic decodes an image that is not animated into a single frame.
+func decodeStatic(data []byte, size image.Point) (*canvas, error) {
+	img, err := Decode(bytes.NewReader(data), size)
+	if err != nil {
+		return nil, err
+	}
+	return &canvas{
+		frames: []*image.RGBA{img},
+		delays: []time.Duration{0},
+	}, nil
+}
+
+// animation made of the frames emitted by the canvas.
+func (c *canvas) animation() *Animation {
+	a := &Animation{
+		Delays: c.delays,
+		Plays:  c.plays,
+	}
+	for _, f := range c.frames {
+		a.Frames = append(a.Frames, paint.NewImageOp(f))
+	}
+	return a
+}
+
+// emit the current state of the canvas as a frame displayed for delay.
+func (c *canvas) emit(delay time.Duration) {
+	if delay < MinDelay {
+		delay = DefaultDelay
+	}
+	frame := image.NewRGBA(image.Rectangle{
+		Max: Fit(c.Bounds().Size(), c.size),
+	})
+	scale(frame, c.RGBA)
+	c.frames = append(c.frames, frame)
+	c.delays = append(c.delays, delay)
+}
+
+// save a copy of the region r of the canvas.
+func (c *canvas) save(r image.Rectangle) *image.RGBA {
+	saved := image.NewRGBA(r)
+	draw.Draw(saved, r, c.RGBA, r.Min, draw.Src)
+	return saved
+}
+
+// clear the region r of the canvas.
+func (c *canvas) clear(r image.Rectangle) {
+	draw.Draw(c.RGBA, r, image.Transparent, image.Point{}, draw.Src)
+}
+
+// restore a region saved earlier.
+func (c *canvas) restore(saved *image.RGBA) {
+	draw.Draw(c.RGBA, saved.Bounds(), saved, saved.Bounds().Min, draw.Src)
+}
+
+func decodeGIF(data []byte, size image.Point) (*canvas, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding gif: %w", err)
+	}
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, frame := range g.Image {
+		bounds = bounds.Union(frame.Bounds())
+	}
+	// LoopCount is the number of repetitions, with 0 meaning forever and -1
+	// meaning none.
+	plays := 0
+	switch {
+	case g.LoopCount < 0:
+		plays = 1
+	case g.LoopCount > 0:
+		plays = g.LoopCount + 1
+	}
+	if err := checkFrames(bounds, len(g.Image)); err != nil {
+		return nil, err
+	}
+	c := newCanvas(bounds, size, plays)
+	for ii, frame := range g.Image {
+		var disposal byte
+		if ii < len(g.Disposal) {
+			disposal = g.Disposal[ii]
+		}
+		var saved *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			saved = c.save(frame.Bounds())
+		}
+		draw.Draw(c.RGBA, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		var delay time.Duration
+		if ii < len(g.Delay) {
+			delay = time.Duration(g.Delay[ii]) * 10 * time.Millisecond
+		}
+		c.emit(delay)
+		switch disposal {
+		case gif.DisposalBackground:
+			c.clear(frame.Bounds())
+		case gif.DisposalPrevious:
+			c.restore(saved)
+		}
+	}
+	return c, nil
+}
+
+// pngSignature begins every PNG file.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Operations applied by APNG frames.
+const (
+	apngDisposeNone = iota
+	apngDisposeBackground
+	apngDisposePrevious
+)
+
+const (
+	apngBlendSource = iota
+	apngBlendOver
+)
+
+// apngFrame is a frame of an APNG, as described by its fcTL chunk.
+type apngFrame struct {
+	bounds   image.Rectangle
+	delay    time.Duration
+	dispose  byte
+	blend    byte
+	data     []byte
+	hasImage bool
+}
+
+// pngChunk is a chunk of a PNG file.
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+// readChunks splits PNG data into its chunks, not including the signature.
+func readChunks(data []byte) ([]pngChunk, error) {
+	data = data[len(pngSignature):]
+	var chunks []pngChunk
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return nil, errors.New("truncated chunk")
+		}
+		n := binary.BigEndian.Uint32(data[:4])
+		if uint64(n) > uint64(len(data)-12) {
+			return nil, errors.New("truncated chunk")
+		}
+		chunks = append(chunks, pngChunk{
+			kind: string(data[4:8]),
+			data: data[8 : 8+n],
+		})
+		data = data[12+n:]
+	}
+	return chunks, nil
+}
+
+// writeChunk appends a chunk to the PNG in buf.
+func writeChunk(buf *bytes.Buffer, kind string, data []byte) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(data)))
+	buf.Write(b[:])
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	buf.WriteString(kind)
+	buf.Write(data)
+	binary.BigEndian.PutUint32(b[:], crc.Sum32())
+	buf.Write(b[:])
+}
+
+// decodeAPNG decodes an animated PNG. Each frame is reassembled into a PNG of
+// its own, using the header of the image, and decoded with image/png.
+func decodeAPNG(data []byte, size image.Point) (*canvas, error) {
+	chunks, err := readChunks(data)
+	if err != nil {
+		return nil, fmt.Errorf("decoding apng: %w", err)
+	}
+	var (
+		ihdr     []byte
+		header   []pngChunk
+		frames   []*apngFrame
+		animated bool
+		plays    int
+		seenIDAT bool
+	)
+	for _, c := range chunks {
+		switch c.kind {
+		case "IHDR":
+			ihdr = c.data
+		case "acTL":
+			if len(c.data) < 8 {
+				return nil, errors.New("decoding apng: invalid acTL")
+			}
+			animated = true
+			plays = int(binary.BigEndian.Uint32(c.data[4:8]))
+		case "fcTL":
+			if len(c.data) < 26 {
+				return nil, errors.New("decoding apng: invalid fcTL")
+			}
+			b := c.data[4:]
+			w, h := binary.BigEndian.Uint32(b[0:4]), binary.BigEndian.Uint32(b[4:8])
+			x, y := binary.BigEndian.Uint32(b[8:12]), binary.BigEndian.Uint32(b[12:16])
+			num, den := binary.BigEndian.Uint16(b[16:18]), binary.BigEndian.Uint16(b[18:20])
+			if den == 0 {
+				den = 100
+			}
+			frames = append(frames, &apngFrame{
+				bounds:  image.Rect(int(x), int(y), int(x+w), int(y+h)),
+				delay:   time.Duration(num) * time.Second / time.Duration(den),
+				dispose: b[20],
+				blend:   b[21],
+			})
+		case "IDAT":
+			seenIDAT = true
+			// The default image is only part of the animation if a fcTL
+			// precedes it.
+			if len(frames) == 1 {
+				frames[0].data = append(frames[0].data, c.data...)
+				frames[0].hasImage = true
+			}
+		case "fdAT":
+			if len(frames) == 0 || len(c.data) < 4 {
+				return nil, errors.New("decoding apng: invalid fdAT")
+			}
+			f := frames[len(frames)-1]
+			f.data = append(f.data, c.data[4:]...)
+			f.hasImage = true
+		case "IEND":
+		default:
+			if !seenIDAT {
+				header = append(header, c)
+			}
+		}
+	}
+	if !animated || len(frames) == 0 {
+		return decodeStatic(data, size)
+	}
+	if len(ihdr) < 13 {
+		return nil, errors.New("decoding apng: invalid IHDR")
+	}
+	bounds := image.Rect(0, 0,
+		int(binary.BigEndian.Uint32(ihdr[0:4])),
+		int(binary.BigEndian.Uint32(ihdr[4:8])))
+	var count int
+	for _, f := range frames {
+		if f.hasImage {
+			count++
+		}
+	}
+	if err := checkFrames(bounds, count); err != nil {
+		return nil, err
+	}
+	c := newCanvas(bounds, size, plays)
+	for ii, f := range frames {
+		if !f.hasImage {
+			continue
+		}
+		if !f.bounds.In(bounds) {
+			return nil, fmt.Errorf("decoding apng: frame %d out of bounds", ii)
+		}
+		var buf bytes.Buffer
+		buf.Write(pngSignature)
+		frameHeader := append([]byte(nil), ihdr...)
+		binary.BigEndian.PutUint32(frameHeader[0:4], uint32(f.bounds.Dx()))
+		binary.BigEndian.PutUint32(frameHeader[4:8], uint32(f.bounds.Dy()))
+		writeChunk(&buf, "IHDR", frameHeader)
+		for _, h := range header {
+			writeChunk(&buf, h.kind, h.data)
+		}
+		writeChunk(&buf, "IDAT", f.data)
+		writeChunk(&buf, "IEND", nil)
+		img, err := png.Decode(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("decoding apng frame %d: %w", ii, err)
+		}
+		dispose := f.dispose
+		if ii == 0 && dispose == apngDisposePrevious {
+			dispose = apngDisposeBackground
+		}
+		var saved *image.RGBA
+		if dispose == apngDisposePrevious {
+			saved = c.save(f.bounds)
+		}
+		op := draw.Over
+		if f.blend == apngBlendSource {
+			op = draw.Src
+		}
+		draw.Draw(c.RGBA, f.bounds, img, img.Bounds().Min, op)
+		c.emit(f.delay)
+		switch dispose {
+		case apngDisposeBackground:
+			c.clear(f.bounds)
+		case apngDisposePrevious:
+			c.restore(saved)
+		}
+	}
+	if len(c.frames) == 0 {
+		return nil, errors.New("decoding apng: no frames")
+	}
+	return c, nil
+}
@@ -0,0 +1,262 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+	"time"
+
+	"gioui.org/op/paint"
+)
+
+var (
+	red   = color.RGBA{R: 0xFF, A: 0xFF}
+	green = color.RGBA{G: 0xFF, A: 0xFF}
+	clear = color.RGBA{}
+)
+
+// uniform returns an image of the given bounds filled with c.
+func uniform(bounds image.Rectangle, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(bounds)
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestAnimationFrameAt(t *testing.T) {
+	a := &Animation{
+		Frames: make([]paint.ImageOp, 3),
+		Delays: []time.Duration{10, 20, 30},
+		Plays:  2,
+	}
+	for _, tc := range []struct {
+		elapsed   time.Duration
+		index     int
+		remaining time.Duration
+	}{
+		{elapsed: 0, index: 0, remaining: 10},
+		{elapsed: 15, index: 1, remaining: 15},
+		{elapsed: 59, index: 2, remaining: 1},
+		{elapsed: 65, index: 0, remaining: 5},
+		{elapsed: 120, index: 2, remaining: 0},
+	} {
+		index, remaining := a.FrameAt(tc.elapsed)
+		if index != tc.index || remaining != tc.remaining {
+			t.Errorf("at %d: expected frame %d for %d, got frame %d for %d",
+				tc.elapsed, tc.index, tc.remaining, index, remaining)
+		}
+	}
+}
+
+func TestDecodeGIF(t *testing.T) {
+	bounds := image.Rect(0, 0, 4, 4)
+	paletted := func(r image.Rectangle, c color.Color) *image.Paletted {
+		img := image.NewPaletted(r, palette.Plan9)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image: []*image.Paletted{
+			paletted(bounds, red),
+			paletted(image.Rect(1, 1, 3, 3), green),
+			paletted(image.Rect(0, 0, 1, 1), green),
+		},
+		Delay:     []int{5, 0, 5},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+		LoopCount: -1,
+		Config:    image.Config{Width: 4, Height: 4},
+	})
+	if err != nil {
+		t.Fatalf("encoding gif: %v", err)
+	}
+	c, err := decodeGIF(buf.Bytes(), image.Point{})
+	if err != nil {
+		t.Fatalf("decoding gif: %v", err)
+	}
+	if c.plays != 1 {
+		t.Errorf("expected a single play, got %d", c.plays)
+	}
+	if want := []time.Duration{50 * time.Millisecond, DefaultDelay, 50 * time.Millisecond}; !equalDelays(c.delays, want) {
+		t.Errorf("expected delays %v, got %v", want, c.delays)
+	}
+	for _, tc := range []struct {
+		frame int
+		at    image.Point
+		color color.RGBA
+	}{
+		{frame: 0, at: image.Pt(1, 1), color: red},
+		{frame: 1, at: image.Pt(1, 1), color: green},
+		{frame: 1, at: image.Pt(0, 0), color: red},
+		// The second frame is disposed of to the background.
+		{frame: 2, at: image.Pt(1, 1), color: clear},
+		{frame: 2, at: image.Pt(0, 0), color: green},
+		{frame: 2, at: image.Pt(3, 3), color: red},
+	} {
+		if got := c.frames[tc.frame].RGBAAt(tc.at.X, tc.at.Y); got != tc.color {
+			t.Errorf("frame %d at %v: expected %v, got %v", tc.frame, tc.at, tc.color, got)
+		}
+	}
+}
+
+// apngFrameSpec describes a frame of an APNG built by encodeAPNG.
+type apngFrameSpec struct {
+	img            *image.NRGBA
+	delay          uint16
+	dispose, blend byte
+}
+
+// encodeAPNG builds an APNG out of frames, the first of which is the default
+// image.
+func encodeAPNG(t *testing.T, plays uint32, frames []apngFrameSpec) []byte {
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	seq := uint32(0)
+	u32 := func(v uint32) []byte {
+		return binary.BigEndian.AppendUint32(nil, v)
+	}
+	for ii, f := range frames {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, f.img); err != nil {
+			t.Fatalf("encoding frame %d: %v", ii, err)
+		}
+		chunks, err := readChunks(buf.Bytes())
+		if err != nil {
+			t.Fatalf("reading frame %d: %v", ii, err)
+		}
+		if ii == 0 {
+			writeChunk(&out, "IHDR", chunks[0].data)
+			writeChunk(&out, "acTL", append(u32(uint32(len(frames))), u32(plays)...))
+		}
+		b := f.img.Bounds()
+		fctl := u32(seq)
+		fctl = append(fctl, u32(uint32(b.Dx()))...)
+		fctl = append(fctl, u32(uint32(b.Dy()))...)
+		fctl = append(fctl, u32(uint32(b.Min.X))...)
+		fctl = append(fctl, u32(uint32(b.Min.Y))...)
+		fctl = binary.BigEndian.AppendUint16(fctl, f.delay)
+		fctl = binary.BigEndian.AppendUint16(fctl, 1000)
+		fctl = append(fctl, f.dispose, f.blend)
+		writeChunk(&out, "fcTL", fctl)
+		seq++
+		for _, c := range chunks {
+			if c.kind != "IDAT" {
+				continue
+			}
+			if ii == 0 {
+				writeChunk(&out, "IDAT", c.data)
+			} else {
+				writeChunk(&out, "fdAT", append(u32(seq), c.data...))
+				seq++
+			}
+		}
+	}
+	writeChunk(&out, "IEND", nil)
+	return out.Bytes()
+}
+
+func TestDecodeAPNG(t *testing.T) {
+	data := encodeAPNG(t, 3, []apngFrameSpec{
+		{img: uniform(image.Rect(0, 0, 4, 4), red), delay: 100},
+		{img: uniform(image.Rect(1, 1, 3, 3), green), delay: 200, dispose: apngDisposePrevious},
+		{img: uniform(image.Rect(0, 0, 1, 1), green), delay: 300, blend: apngBlendOver},
+	})
+	c, err := decodeAPNG(data, image.Point{})
+	if err != nil {
+		t.Fatalf("decoding apng: %v", err)
+	}
+	if c.plays != 3 || len(c.frames) != 3 {
+		t.Fatalf("expected 3 frames played 3 times, got %d frames played %d times", len(c.frames), c.plays)
+	}
+	if want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}; !equalDelays(c.delays, want) {
+		t.Errorf("expected delays %v, got %v", want, c.delays)
+	}
+	for _, tc := range []struct {
+		frame int
+		at    image.Point
+		color color.RGBA
+	}{
+		{frame: 0, at: image.Pt(1, 1), color: red},
+		{frame: 1, at: image.Pt(1, 1), color: green},
+		{frame: 1, at: image.Pt(0, 0), color: red},
+		// The second frame is disposed of to the previous state.
+		{frame: 2, at: image.Pt(1, 1), color: red},
+		{frame: 2, at: image.Pt(0, 0), color: green},
+	} {
+		if got := c.frames[tc.frame].RGBAAt(tc.at.X, tc.at.Y); got != tc.color {
+			t.Errorf("frame %d at %v: expected %v, got %v", tc.frame, tc.at, tc.color, got)
+		}
+	}
+
+	// A PNG without animation control is decoded as a single frame.
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, uniform(image.Rect(0, 0, 4, 4), red)); err != nil {
+		t.Fatalf("encoding png: %v", err)
+	}
+	a, err := DecodeAnimation(&buf, image.Pt(2, 2))
+	if err != nil {
+		t.Fatalf("decoding png: %v", err)
+	}
+	if len(a.Frames) != 1 || a.Frames[0].Size() != image.Pt(2, 2) {
+		t.Errorf("expected a single 2x2 frame, got %d frames", len(a.Frames))
+	}
+}
+
+// TestDecodeAnimationTooLarge ensures that animations whose frames exceed
+// MaxPixels in total are rejected before they are composited, even if each
+// frame is small.
+func TestDecodeAnimationTooLarge(t *testing.T) {
+	// Enough frames of a 1024x1024 canvas to exceed MaxPixels by one.
+	bounds := image.Rect(0, 0, 1024, 1024)
+	n := MaxPixels/(bounds.Dx()*bounds.Dy()) + 1
+	g := &gif.GIF{Config: image.Config{Width: bounds.Dx(), Height: bounds.Dy()}}
+	for ii := 0; ii < n; ii++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), palette.Plan9))
+		g.Delay = append(g.Delay, 0)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("encoding gif: %v", err)
+	}
+	if _, err := DecodeAnimation(bytes.NewReader(buf.Bytes()), image.Point{}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected the gif to be rejected as too large, got %v", err)
+	}
+
+	frames := []apngFrameSpec{{img: image.NewNRGBA(bounds)}}
+	for len(frames) < n {
+		frames = append(frames, apngFrameSpec{img: image.NewNRGBA(image.Rect(0, 0, 1, 1))})
+	}
+	data := encodeAPNG(t, 0, frames)
+	if _, err := DecodeAnimation(bytes.NewReader(data), image.Point{}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected the apng to be rejected as too large, got %v", err)
+	}
+	// One frame fewer fits.
+	if _, err := decodeAPNG(encodeAPNG(t, 0, frames[:n-1]), image.Pt(1, 1)); err != nil {
+		t.Errorf("expected %d frames to fit, got %v", n-1, err)
+	}
+}
+
+func equalDelays(a, b []time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ii := range a {
+		if a[ii] != b[ii] {
+			return false
+		}
+	}
+	return true
+}
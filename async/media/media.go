@@ -0,0 +1,249 @@
+// Package media loads images asynchronously, decoding and downsampling them
+// to their display size off of the UI goroutine.
+//
+// PNG, JPEG, GIF, and WebP images are supported. Only the first frame of an
+// animated image is decoded by Decode, while DecodeAnimation decodes every
+// frame of animated GIF and PNG (APNG) images.
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net/http"
+	"os"
+
+	"gioui.org/op/paint"
+	"git.sr.ht/~gioverse/chat/async"
+	xdraw "golang.org/x/image/draw"
+
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels is the largest image, in pixels, that is decoded. Larger images
+// are rejected with ErrTooLarge before being decoded, as they would exhaust
+// memory.
+const MaxPixels = 64 << 20
+
+// ErrTooLarge is reported for images larger than MaxPixels.
+var ErrTooLarge = errors.New("image is too large")
+
+// Source opens an encoded image for reading.
+type Source func(ctx context.Context) (io.ReadCloser, error)
+
+// File is a Source reading the image at path.
+func File(path string) Source {
+	return func(context.Context) (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// URL is a Source downloading the image at u. The progress of the download
+// is reported to the ProgressFunc of ctx (see async.Progress), if the size of
+// the image is known.
+func URL(u string) Source {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, fmt.Errorf("GET: %w", err)
+		}
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("GET: %w", err)
+		}
+		if r.StatusCode != http.StatusOK {
+			r.Body.Close()
+			return nil, fmt.Errorf("GET: %s", r.Status)
+		}
+		if r.ContentLength <= 0 {
+			return r.Body, nil
+		}
+		return &progressReader{
+			ReadCloser: r.Body,
+			total:      r.ContentLength,
+			report:     async.Progress(ctx),
+		}, nil
+	}
+}
+
+// progressReader reports the progress of reading a body of known length.
+type progressReader struct {
+	io.ReadCloser
+	read, total int64
+	report      async.ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.read += int64(n)
+	p.report(nil, float32(p.read)/float32(p.total))
+	return n, err
+}
+
+// Image describes an image to load.
+type Image struct {
+	// Key identifies the encoded image, like its URL. Images with the same
+	// key and size share a single load. Defaults to the tag of the image.
+	Key async.Tag
+	// Source of the encoded image.
+	Source Source
+	// Size the image is displayed at, in pixels. The image is scaled down to
+	// fit, preserving its aspect ratio. Zero dimensions are unconstrained.
+	Size image.Point
+}
+
+// key identifies an image at a size.
+type key struct {
+	key  async.Tag
+	size image.Point
+}
+
+// Loader loads images asynchronously, decoding them into a paint.ImageOp
+// ready to be laid out.
+type Loader struct {
+	async.Loader
+}
+
+// Schedule the image to be loaded, returning a resource that will hold the
+// ImageOp at some point. Like async.Loader.Schedule, it should be called
+// every frame the image is laid out.
+//
+// Resources are keyed by the Key and Size of the image, so the async.WithKey
+// option has no effect.
+func (l *Loader) Schedule(tag async.Tag, img Image, opts ...async.ScheduleOption) async.TypedResource[paint.ImageOp] {
+	r := l.Loader.ScheduleErr(tag, func(ctx context.Context) (interface{}, error) {
+		op, err := Load(ctx, img.Source, img.Size)
+		if err != nil {
+			return nil, err
+		}
+		return op, nil
+	}, withKey(tag, img, opts)...)
+	return typed[paint.ImageOp](r)
+}
+
+// typed converts r into a resource of type V. Values of other types, such as
+// partial values of a different type, are reported as the zero value.
+func typed[V any](r async.Resource) async.TypedResource[V] {
+	v, _ := r.Value.(V)
+	return async.TypedResource[V]{
+		State:    r.State,
+		Value:    v,
+		Progress: r.Progress,
+		Err:      r.Err,
+	}
+}
+
+// withKey appends the option keying the resource for img to opts.
+func withKey(tag async.Tag, img Image, opts []async.ScheduleOption) []async.ScheduleOption {
+	k := key{key: img.Key, size: img.Size}
+	if k.key == nil {
+		k.key = tag
+	}
+	return append(opts, async.WithKey(k))
+}
+
+// Load and decode the image from src, scaling it down to fit size.
+func Load(ctx context.Context, src Source, size image.Point) (paint.ImageOp, error) {
+	img, err := LoadImage(ctx, src, size)
+	if err != nil {
+		return paint.ImageOp{}, err
+	}
+	return paint.NewImageOp(img), nil
+}
+
+// LoadImage loads and decodes the image from src like Load, for callers
+// that need the image itself rather than an ImageOp.
+func LoadImage(ctx context.Context, src Source, size image.Point) (*image.RGBA, error) {
+	r, err := src(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening image: %w", err)
+	}
+	defer r.Close()
+	img, err := Decode(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Decode an image from r, scaling it down to fit size. The image is converted
+// to RGBA, which is uploaded to the GPU without further conversion. Images
+// larger than MaxPixels are rejected with ErrTooLarge.
+func Decode(r io.Reader, size image.Point) (*image.RGBA, error) {
+	// Check the size of the image from its header first, then decode the
+	// image from the header along with the rest of r.
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	if err := checkSize(cfg); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, fmt.Errorf("decoding image: %w", err)
+	}
+	dst := image.NewRGBA(image.Rectangle{
+		Max: Fit(src.Bounds().Size(), size),
+	})
+	scale(dst, src)
+	return dst, nil
+}
+
+// checkSize reports ErrTooLarge for images larger than MaxPixels.
+func checkSize(cfg image.Config) error {
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return fmt.Errorf("decoding image: %w: %dx%d", ErrTooLarge, cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// scale src to fill dst.
+func scale(dst *image.RGBA, src image.Image) {
+	if dst.Bounds().Size() == src.Bounds().Size() {
+		draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
+	} else {
+		xdraw.BiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+	}
+}
+
+// Fit returns the size of an image of the given size once scaled down to fit
+// within max, preserving its aspect ratio. Zero dimensions of max are
+// unconstrained. Images are never scaled up.
+func Fit(size, max image.Point) image.Point {
+	scale := 1.0
+	if max.X > 0 && size.X > max.X {
+		scale = float64(max.X) / float64(size.X)
+	}
+	if max.Y > 0 && size.Y > max.Y {
+		if s := float64(max.Y) / float64(size.Y); s < scale {
+			scale = s
+		}
+	}
+	if scale == 1 {
+		return size
+	}
+	fit := image.Point{
+		X: int(float64(size.X)*scale + 0.5),
+		Y: int(float64(size.Y)*scale + 0.5),
+	}
+	if fit.X < 1 {
+		fit.X = 1
+	}
+	if fit.Y < 1 {
+		fit.Y = 1
+	}
+	return fit
+}
@@ -0,0 +1,149 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+
+	"gioui.org/op/paint"
+	"git.sr.ht/~gioverse/chat/async"
+)
+
+func TestFit(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		size, max, fit image.Point
+	}{
+		{
+			name: "unconstrained",
+			size: image.Pt(400, 200),
+			fit:  image.Pt(400, 200),
+		},
+		{
+			name: "smaller than max",
+			size: image.Pt(40, 20),
+			max:  image.Pt(100, 100),
+			fit:  image.Pt(40, 20),
+		},
+		{
+			name: "wide",
+			size: image.Pt(400, 200),
+			max:  image.Pt(100, 100),
+			fit:  image.Pt(100, 50),
+		},
+		{
+			name: "tall",
+			size: image.Pt(200, 400),
+			max:  image.Pt(100, 100),
+			fit:  image.Pt(50, 100),
+		},
+		{
+			name: "width only",
+			size: image.Pt(400, 200),
+			max:  image.Pt(200, 0),
+			fit:  image.Pt(200, 100),
+		},
+		{
+			name: "degenerate",
+			size: image.Pt(1000, 1),
+			max:  image.Pt(10, 10),
+			fit:  image.Pt(10, 1),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if fit := Fit(tc.size, tc.max); fit != tc.fit {
+				t.Errorf("expected %v to fit %v as %v, got %v", tc.size, tc.max, tc.fit, fit)
+			}
+		})
+	}
+}
+
+// encode a uniformly colored png of the given size.
+func encode(t *testing.T, size image.Point) []byte {
+	img := image.NewNRGBA(image.Rectangle{Max: size})
+	for ii := range img.Pix {
+		img.Pix[ii] = 0xFF
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encoding png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	img, err := Decode(bytes.NewReader(encode(t, image.Pt(64, 32))), image.Pt(16, 16))
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(16, 8) {
+		t.Errorf("expected the image to be scaled down to 16x8, got %v", size)
+	}
+	if c := img.RGBAAt(8, 4); c != (color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF}) {
+		t.Errorf("expected the color to survive scaling, got %v", c)
+	}
+	if _, err := Decode(bytes.NewReader([]byte("not an image")), image.Point{}); err == nil {
+		t.Errorf("expected an error decoding garbage")
+	}
+}
+
+// TestDecodeTooLarge ensures that images larger than MaxPixels are rejected
+// from their header, before being decoded.
+func TestDecodeTooLarge(t *testing.T) {
+	// A PNG header claiming a 16384x16384 image, without any pixels.
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 1<<14)
+	binary.BigEndian.PutUint32(ihdr[4:], 1<<14)
+	ihdr[8], ihdr[9] = 8, 6 // 8 bit RGBA.
+	writeChunk(&buf, "IHDR", ihdr)
+	writeChunk(&buf, "IEND", nil)
+	if _, err := Decode(bytes.NewReader(buf.Bytes()), image.Point{}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected Decode to reject the image as too large, got %v", err)
+	}
+	if _, err := DecodeAnimation(bytes.NewReader(buf.Bytes()), image.Point{}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected DecodeAnimation to reject the image as too large, got %v", err)
+	}
+}
+
+// TestLoader ensures that loaded images are decoded at their display size,
+// and that the same image at different sizes is loaded separately.
+func TestLoader(t *testing.T) {
+	s := &async.ManualScheduler{}
+	l := &Loader{}
+	l.Scheduler = s
+	defer l.Shutdown()
+	data := encode(t, image.Pt(100, 100))
+	opens := 0
+	src := func(context.Context) (io.ReadCloser, error) {
+		opens++
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	var small, large async.TypedResource[paint.ImageOp]
+	frame := func() {
+		l.Step(func() {
+			small = l.Schedule("small", Image{Key: "a", Source: src, Size: image.Pt(10, 10)})
+			large = l.Schedule("large", Image{Key: "a", Source: src, Size: image.Pt(50, 50)})
+		})
+		l.Sync()
+	}
+	frame()
+	s.RunPending()
+	frame()
+	if small.State != async.Loaded || small.Value.Size() != image.Pt(10, 10) {
+		t.Errorf("expected a 10x10 image, got %+v", small)
+	}
+	if large.State != async.Loaded || large.Value.Size() != image.Pt(50, 50) {
+		t.Errorf("expected a 50x50 image, got %+v", large)
+	}
+	if opens != 2 {
+		t.Errorf("expected the image to be loaded once per size, got %d loads", opens)
+	}
+}
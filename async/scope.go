@@ -0,0 +1,117 @@
+package async
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+
+	"gioui.org/layout"
+)
+
+// scope tracks the frames laid out by a view using a Loader.
+type scope struct {
+	// active frame being layed out.
+	// Access must be synchronized with atomics.
+	active int64
+	// finished frames that have been layed out.
+	// Access must be synchronized with atomics.
+	finished int64
+	// closed is non-zero once the view is gone.
+	// Access must be synchronized with atomics.
+	closed int32
+}
+
+// recency of the given frame of the scope: positive during the active frame,
+// zero for the most recently finished frame, and negative for older frames.
+func (sc *scope) recency(frame int64) int64 {
+	if sc.isClosed() {
+		return math.MinInt64
+	}
+	return frame - atomic.LoadInt64(&sc.finished)
+}
+
+// isClosed reports whether the view is gone.
+func (sc *scope) isClosed() bool {
+	return atomic.LoadInt32(&sc.closed) != 0
+}
+
+// FrameScope tracks the frames of one of several views sharing a Loader, like
+// the windows of an application. Each view lays out its frames at its own
+// pace, so the staleness of resources is judged per scope: a resource stays
+// alive for as long as any scope keeps scheduling it.
+//
+// Use the methods of the scope in place of those of the Loader.
+type FrameScope struct {
+	loader *Loader
+	scope
+	// updated reports that a resource's status has changed.
+	updated chan struct{}
+}
+
+// NewScope returns a new FrameScope for a view sharing the loader. Close the
+// scope once the view is gone.
+func (l *Loader) NewScope() *FrameScope {
+	sc := &FrameScope{
+		loader:  l,
+		updated: make(chan struct{}, 1),
+	}
+	l.scopesMu.Lock()
+	defer l.scopesMu.Unlock()
+	if l.closed {
+		close(sc.updated)
+		return sc
+	}
+	if l.scopes == nil {
+		l.scopes = make(map[*FrameScope]struct{})
+	}
+	l.scopes[sc] = struct{}{}
+	return sc
+}
+
+// Frame wraps a widget of the view and tracks frame updates, like
+// Loader.Frame.
+func (sc *FrameScope) Frame(gtx layout.Context, w layout.Widget) layout.Dimensions {
+	var dim layout.Dimensions
+	sc.Step(func() {
+		dim = w(gtx)
+	})
+	return dim
+}
+
+// Step counts a frame of the view during which fn schedules resources, like
+// Loader.Step.
+func (sc *FrameScope) Step(fn func()) {
+	sc.loader.step(&sc.scope, fn)
+}
+
+// Schedule a resource on behalf of the view, like Loader.Schedule.
+func (sc *FrameScope) Schedule(tag Tag, load LoadFunc, opts ...ScheduleOption) Resource {
+	return sc.ScheduleErr(tag, func(ctx context.Context) (interface{}, error) {
+		return load(ctx), nil
+	}, opts...)
+}
+
+// ScheduleErr schedules a resource on behalf of the view, like
+// Loader.ScheduleErr.
+func (sc *FrameScope) ScheduleErr(tag Tag, load LoadErrFunc, opts ...ScheduleOption) Resource {
+	return sc.loader.schedule(&sc.scope, tag, load, opts)
+}
+
+// Updated returns a channel that reports whether the loader has been updated,
+// like Loader.Updated. Each scope has its own channel, so that every view
+// can be invalidated. The channel is closed once the loader is shut down.
+func (sc *FrameScope) Updated() <-chan struct{} {
+	return sc.updated
+}
+
+// Close the scope, so that it no longer keeps resources alive.
+func (sc *FrameScope) Close() {
+	atomic.StoreInt32(&sc.closed, 1)
+	l := sc.loader
+	l.scopesMu.Lock()
+	delete(l.scopes, sc)
+	l.scopesMu.Unlock()
+	l.loader.mu.Lock()
+	l.loader.wake()
+	l.loader.mu.Unlock()
+}
@@ -0,0 +1,55 @@
+package async
+
+import (
+	"context"
+	"testing"
+)
+
+// TestFrameScopes ensures that the frames of one scope do not make the
+// resources of another stale, and that closed scopes stop keeping their
+// resources alive.
+func TestFrameScopes(t *testing.T) {
+	s := &ManualScheduler{}
+	l := &TypedLoader[string, int]{Loader: Loader{Scheduler: s, MaxLoaded: 1}}
+	defer l.Shutdown()
+	var calls int
+	load := func(context.Context) int {
+		calls++
+		return calls
+	}
+	first, second := l.NewScope(), l.NewScope()
+	first.Step(func() {
+		first.Schedule("a", load)
+	})
+	second.Step(func() {
+		second.Schedule("b", load)
+	})
+	// The first view lays out several frames while the second is idle.
+	for ii := 0; ii < 3; ii++ {
+		first.Step(func() {
+			first.Schedule("a", load)
+		})
+	}
+	l.Sync()
+	s.RunPending()
+	if calls != 2 {
+		t.Errorf("expected the resources of both scopes to load, got %d loads", calls)
+	}
+	if stats := l.Stats(); stats.Lookup != 2 {
+		t.Errorf("expected both resources to be alive, got %+v", stats)
+	}
+
+	second.Close()
+	first.Step(func() {
+		first.Schedule("a", load)
+	})
+	l.Sync()
+	if stats := l.Stats(); stats.Lookup != 1 {
+		t.Errorf("expected the resource of the closed scope to be purged, got %+v", stats)
+	}
+	select {
+	case <-first.Updated():
+	default:
+		t.Errorf("expected the scope to be notified of updates")
+	}
+}
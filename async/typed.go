@@ -0,0 +1,94 @@
+package async
+
+import (
+	"context"
+)
+
+// TypedLoader is a Loader of values of type V, identified by tags of type K.
+// It spares the caller from asserting the type of each loaded value.
+//
+// Partial values reported by loads (see Progress) must also be of type V to
+// be visible.
+type TypedLoader[K comparable, V any] struct {
+	Loader
+}
+
+// Schedule a resource to be loaded asynchronously, like Loader.Schedule.
+func (l *TypedLoader[K, V]) Schedule(tag K, load TypedLoadFunc[V], opts ...ScheduleOption) TypedResource[V] {
+	return l.ScheduleErr(tag, func(ctx context.Context) (V, error) {
+		return load(ctx), nil
+	}, opts...)
+}
+
+// ScheduleErr is like Schedule, but the load may fail, like
+// Loader.ScheduleErr.
+func (l *TypedLoader[K, V]) ScheduleErr(tag K, load TypedLoadErrFunc[V], opts ...ScheduleOption) TypedResource[V] {
+	return typed[V](l.Loader.ScheduleErr(tag, untyped(load), opts...))
+}
+
+// Invalidate the resource with the given tag, like Loader.Invalidate.
+func (l *TypedLoader[K, V]) Invalidate(tag K) {
+	l.Loader.Invalidate(tag)
+}
+
+// InvalidateFunc invalidates every resource whose tag matches, like
+// Loader.InvalidateFunc. Resources scheduled with tags of another type than
+// K, through the Loader, never match.
+func (l *TypedLoader[K, V]) InvalidateFunc(match func(tag K) bool) {
+	l.Loader.InvalidateFunc(func(tag Tag) bool {
+		t, ok := tag.(K)
+		return ok && match(t)
+	})
+}
+
+// Refresh loads the resource with the given tag again, like Loader.Refresh.
+func (l *TypedLoader[K, V]) Refresh(tag K) {
+	l.Loader.Refresh(tag)
+}
+
+// NewScope returns a new TypedFrameScope for a view sharing the loader, like
+// Loader.NewScope.
+func (l *TypedLoader[K, V]) NewScope() *TypedFrameScope[K, V] {
+	return &TypedFrameScope[K, V]{FrameScope: l.Loader.NewScope()}
+}
+
+// TypedFrameScope is a FrameScope of a TypedLoader.
+type TypedFrameScope[K comparable, V any] struct {
+	*FrameScope
+}
+
+// Schedule a resource on behalf of the view, like TypedLoader.Schedule.
+func (sc *TypedFrameScope[K, V]) Schedule(tag K, load TypedLoadFunc[V], opts ...ScheduleOption) TypedResource[V] {
+	return sc.ScheduleErr(tag, func(ctx context.Context) (V, error) {
+		return load(ctx), nil
+	}, opts...)
+}
+
+// ScheduleErr schedules a resource on behalf of the view, like
+// TypedLoader.ScheduleErr.
+func (sc *TypedFrameScope[K, V]) ScheduleErr(tag K, load TypedLoadErrFunc[V], opts ...ScheduleOption) TypedResource[V] {
+	return typed[V](sc.FrameScope.ScheduleErr(tag, untyped(load), opts...))
+}
+
+// untyped converts load into a LoadErrFunc.
+func untyped[V any](load TypedLoadErrFunc[V]) LoadErrFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		v, err := load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+// typed converts r into a resource of type V. Values of other types, such as
+// partial values of a different type, are reported as the zero value.
+func typed[V any](r Resource) TypedResource[V] {
+	v, _ := r.Value.(V)
+	return TypedResource[V]{
+		State:    r.State,
+		Value:    v,
+		Progress: r.Progress,
+		Err:      r.Err,
+	}
+}
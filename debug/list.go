@@ -0,0 +1,92 @@
+package debug
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gioui.org/widget/material"
+	"git.sr.ht/~gioverse/chat/list"
+)
+
+// ListStats is a list.Observer that aggregates the metrics reported by a
+// list.Manager and lays them out as a translucent overlay. Install it as the
+// Observer hook of the Manager, and lay it out atop the list.
+type ListStats struct {
+	mu sync.Mutex
+	// loads holds the load statistics indexed by list.Direction.
+	loads     [list.Both]durationStat
+	synthesis durationStat
+	// compacted is the total number of elements compacted.
+	compacted int
+	// batch is the size of the most recent batch of pending updates, and
+	// maxBatch the size of the largest.
+	batch, maxBatch int
+	// invalidations is the number of calls to the Invalidator.
+	invalidations int
+}
+
+// durationStat aggregates the durations and element counts of an operation.
+type durationStat struct {
+	count       int
+	elements    int
+	last, total time.Duration
+}
+
+func (d *durationStat) add(m list.Metric) {
+	d.count++
+	d.elements += m.Count
+	d.last = m.Duration
+	d.total += m.Duration
+}
+
+func (d durationStat) String() string {
+	if d.count == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d (%d elements), last %v, mean %v",
+		d.count, d.elements, d.last, d.total/time.Duration(d.count))
+}
+
+// Observe implements list.Observer.
+func (s *ListStats) Observe(m list.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.Kind {
+	case list.LoadMetric:
+		if int(m.Direction) < len(s.loads) {
+			s.loads[m.Direction].add(m)
+		}
+	case list.CompactMetric:
+		s.compacted += m.Count
+	case list.SynthesisMetric:
+		s.synthesis.add(m)
+	case list.BatchMetric:
+		s.batch = m.Count
+		if m.Count > s.maxBatch {
+			s.maxBatch = m.Count
+		}
+	case list.InvalidateMetric:
+		s.invalidations++
+	}
+}
+
+// String summarizes the stats, one per line.
+func (s *ListStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b strings.Builder
+	fmt.Fprintf(&b, "loads before: %v\n", s.loads[list.Before])
+	fmt.Fprintf(&b, "loads after: %v\n", s.loads[list.After])
+	fmt.Fprintf(&b, "syntheses: %v\n", s.synthesis)
+	fmt.Fprintf(&b, "compacted: %d elements\n", s.compacted)
+	fmt.Fprintf(&b, "pending updates: %d, max %d\n", s.batch, s.maxBatch)
+	fmt.Fprintf(&b, "invalidations: %d", s.invalidations)
+	return b.String()
+}
+
+// Layout the stats as a block of text over a translucent background.
+func (s *ListStats) Layout(gtx C, th *material.Theme) D {
+	return overlay(gtx, th, s.String())
+}
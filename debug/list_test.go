@@ -0,0 +1,107 @@
+package debug
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gioui.org/layout"
+	"git.sr.ht/~gioverse/chat/list"
+)
+
+// TestListStats ensures that the metrics fed through the Observer are
+// aggregated.
+func TestListStats(t *testing.T) {
+	var (
+		stats ListStats
+		o     list.Observer = &stats
+	)
+	for _, m := range []list.Metric{
+		{Kind: list.LoadMetric, Direction: list.After, Duration: 10 * time.Millisecond, Count: 5},
+		{Kind: list.LoadMetric, Direction: list.After, Duration: 30 * time.Millisecond, Count: 3},
+		{Kind: list.LoadMetric, Direction: list.Before, Duration: time.Millisecond, Count: 1},
+		{Kind: list.CompactMetric, Count: 2},
+		{Kind: list.CompactMetric, Count: 4},
+		{Kind: list.SynthesisMetric, Duration: 2 * time.Millisecond, Count: 8},
+		{Kind: list.BatchMetric, Count: 3},
+		{Kind: list.BatchMetric, Count: 1},
+		{Kind: list.InvalidateMetric},
+		{Kind: list.InvalidateMetric},
+	} {
+		o.Observe(m)
+	}
+	want := strings.Join([]string{
+		"loads before: 1 (1 elements), last 1ms, mean 1ms",
+		"loads after: 2 (8 elements), last 30ms, mean 20ms",
+		"syntheses: 1 (8 elements), last 2ms, mean 2ms",
+		"compacted: 6 elements",
+		"pending updates: 1, max 3",
+		"invalidations: 2",
+	}, "\n")
+	if got := stats.String(); got != want {
+		t.Errorf("expected stats:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+// TestListStatsObserver ensures that ListStats aggregates the metrics of a
+// list.Manager it is installed in.
+func TestListStatsObserver(t *testing.T) {
+	var stats ListStats
+	invalidated := make(chan struct{}, 1)
+	m := list.NewManager(10, list.Hooks{
+		Synthesizer: func(_, current, _ list.Element) []list.Element {
+			return []list.Element{current}
+		},
+		Comparator: func(a, b list.Element) bool { return a.Serial() < b.Serial() },
+		Loader: func(dir list.Direction, relativeTo list.Serial) ([]list.Element, bool) {
+			if relativeTo != list.NoSerial {
+				return nil, false
+			}
+			return []list.Element{element("a"), element("b")}, false
+		},
+		Presenter: func(list.Element, interface{}) layout.Widget { return nil },
+		Allocator: func(list.Element) interface{} { return nil },
+		Invalidator: func() {
+			select {
+			case invalidated <- struct{}{}:
+			default:
+			}
+		},
+		Observer: &stats,
+	})
+	var l layout.List
+	// Request the initial elements until the processing goroutine accepts
+	// the request.
+	timeout := time.After(time.Second)
+	for loaded := false; !loaded; {
+		m.UpdatedLen(&l)
+		select {
+		case <-invalidated:
+			loaded = true
+		case <-time.After(time.Millisecond):
+		case <-timeout:
+			t.Fatalf("timed out waiting for the initial load")
+		}
+	}
+	m.Shutdown()
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if load := stats.loads[list.After]; load.count != 1 || load.elements != 2 {
+		t.Errorf("expected 1 load of 2 elements after, got %d of %d", load.count, load.elements)
+	}
+	if stats.synthesis.count != 1 || stats.synthesis.elements != 2 {
+		t.Errorf("expected 1 synthesis of 2 elements, got %d of %d",
+			stats.synthesis.count, stats.synthesis.elements)
+	}
+	if stats.invalidations != 1 || stats.maxBatch != 1 {
+		t.Errorf("expected 1 invalidation and batches of 1, got %d and %d",
+			stats.invalidations, stats.maxBatch)
+	}
+}
+
+// element is a list.Element for testing.
+type element string
+
+func (e element) Serial() list.Serial {
+	return list.Serial(e)
+}
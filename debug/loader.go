@@ -0,0 +1,34 @@
+package debug
+
+import (
+	"image/color"
+
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/clip"
+	"gioui.org/op/paint"
+	"gioui.org/unit"
+	"gioui.org/widget/material"
+	"git.sr.ht/~gioverse/chat/async"
+)
+
+// LoaderStats lays out a snapshot of the stats of an async loader as a
+// translucent overlay, in the same style as ListStats. Take the snapshot
+// with the Stats method of the loader every frame.
+func LoaderStats(gtx C, th *material.Theme, stats async.LoaderStats) D {
+	return overlay(gtx, th, stats.String())
+}
+
+// overlay lays out text in white over a translucent background.
+func overlay(gtx C, th *material.Theme, text string) D {
+	macro := op.Record(gtx.Ops)
+	dims := layout.UniformInset(unit.Dp(4)).Layout(gtx, func(gtx C) D {
+		l := material.Caption(th, text)
+		l.Color = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		return l.Layout(gtx)
+	})
+	call := macro.Stop()
+	paint.FillShape(gtx.Ops, color.NRGBA{A: 160}, clip.Rect{Max: dims.Size}.Op())
+	call.Add(gtx.Ops)
+	return dims
+}
@@ -254,7 +254,7 @@ func (reel *Reel) Layout(gtx C, loader *async.Loader) D {
 					// You can leak the resource by taking a pointer to it or its
 					// value to ensure it doesn't get garbage collected.
 					r := loader.Schedule(id, func(ctx context.Context) interface{} {
-						img, err := fetch(id, fmt.Sprintf(unsplash, 64, 64))
+						img, err := fetch(ctx, id, fmt.Sprintf(unsplash, 64, 64))
 						if err != nil {
 							log.Printf("error fetching image: %v", err)
 							return nil
@@ -308,10 +308,10 @@ func (reel *Reel) Layout(gtx C, loader *async.Loader) D {
 // unsplash endpoint that returns random nature images for the given dimensions.
 const unsplash = "https://source.unsplash.com/random/%dx%d?nature"
 
-// fetch image for the given id.
+// fetch image for the given id, aborting if ctx is cancelled.
 // Image is initially downloaded from the provided url and stored on disk.
 // If flag `cache` is false, downloads will not be stored on disk.
-func fetch(id, u string) (image.Image, error) {
+func fetch(ctx context.Context, id, u string) (image.Image, error) {
 	if noIO {
 		return nil, nil
 	}
@@ -337,7 +337,7 @@ func fetch(id, u string) (image.Image, error) {
 						}
 					}
 				}()
-				r, err := http.Get(u)
+				r, err := get(ctx, u)
 				if err != nil {
 					return fmt.Errorf("GET: %w", err)
 				}
@@ -365,7 +365,7 @@ func fetch(id, u string) (image.Image, error) {
 		defer f.Close()
 		src = f
 	} else {
-		r, err := http.Get(u)
+		r, err := get(ctx, u)
 		if err != nil {
 			return nil, fmt.Errorf("GET: %w", err)
 		}
@@ -381,3 +381,12 @@ func fetch(id, u string) (image.Image, error) {
 	}
 	return img, nil
 }
+
+// get performs an HTTP GET request for u that is aborted if ctx is cancelled.
+func get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req)
+}
@@ -25,6 +25,8 @@ const inflection = math.MaxInt64 / 2
 type Generator struct {
 	// FetchImage callback fetches an image of the given size.
 	FetchImage func(image.Point) image.Image
+	// Themes are the names of the 9patch themes available to users.
+	Themes []string
 	// old is the serial counter for old messages.
 	old syncInt
 	// new is the serial counter for new messages.
@@ -33,7 +35,7 @@ type Generator struct {
 
 // GenUsers generates some random number of users between min and max.
 func (g *Generator) GenUsers(min, max int) *model.Users {
-	return GenUsers(min, max, g.FetchImage)
+	return GenUsers(min, max, g.Themes, g.FetchImage)
 }
 
 // GenRooms generates some random number of rooms between min and max.
@@ -86,7 +88,9 @@ func GenMessage(
 				image.Pt(300, 300),
 			}
 			sz := sizes[rand.Intn(len(sizes))]
-			return fmt.Sprintf("https://source.unsplash.com/random/%dx%d?nature", sz.X, sz.Y)
+			// The signature makes the URL, and so the image, unique to the
+			// message.
+			return fmt.Sprintf("https://source.unsplash.com/random/%dx%d?nature&sig=%d", sz.X, sz.Y, serial)
 		}(),
 		Read: func() bool {
 			return serial < inflection
@@ -100,24 +104,22 @@ func GenMessage(
 	}
 }
 
-// GenUsers will generate a random number of fake users.
-func GenUsers(min, max int, fetchImage func(image.Point) image.Image) *model.Users {
+// GenUsers will generate a random number of fake users, some of whom use one
+// of the named themes.
+func GenUsers(min, max int, themes []string, fetchImage func(image.Point) image.Image) *model.Users {
 	var (
 		users model.Users
 	)
 	for ii := rand.Intn(max-min) + min; ii > 0; ii-- {
 		users.Add(model.User{
 			Name: lorem.Word(4, 15),
-			Theme: func() model.Theme {
-				if rand.Float32() > 0.7 {
-					if rand.Float32() > 0.5 {
-						return model.ThemePlatoCookie
-					}
-					return model.ThemeHotdog
+			Theme: func() string {
+				if len(themes) > 0 && rand.Float32() > 0.7 {
+					return themes[rand.Intn(len(themes))]
 				}
-				return model.ThemeEmpty
+				return ""
 			}(),
-			Avatar: fmt.Sprintf("https://source.unsplash.com/random/%dx%d?nature", 64, 64),
+			Avatar: fmt.Sprintf("https://source.unsplash.com/random/%dx%d?nature&sig=%d", 64, 64, ii),
 			Color: func() color.NRGBA {
 				return ToNRGBA(colorful.FastHappyColor().Clamped())
 			}(),
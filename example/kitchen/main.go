@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"math/rand"
@@ -33,6 +34,7 @@ func init() {
 	flag.IntVar(&config.Latency, "latency", 1000, "maximum latency (in millis) to simulate")
 	flag.IntVar(&config.LoadSize, "load-size", 30, "number of items to load at a time")
 	flag.IntVar(&config.BufferSize, "buffer-size", 30, "number of elements to hold in memory before compacting")
+	flag.BoolVar(&config.Stats, "stats", false, "display the processing statistics of the active room's list and of the image loader")
 
 	flag.Parse()
 }
@@ -67,6 +69,11 @@ func main() {
 				switch event := event.(type) {
 				case system.DestroyEvent:
 					profiler.Stop()
+					ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+					if err := ui.Shutdown(ctx); err != nil {
+						fmt.Printf("error: shutting down: %v\n", err)
+					}
+					cancel()
 					if err := event.Err; err != nil {
 						fmt.Printf("error: premature window close: %v\n", err)
 						os.Exit(1)
@@ -38,6 +38,12 @@ func (d DateBoundary) Serial() list.Serial {
 	return list.NoSerial
 }
 
+// IsHeader marks the date boundary as a section header, so that the
+// current date sticks to the top of the list.
+func (d DateBoundary) IsHeader() bool {
+	return true
+}
+
 // UnreadBoundary represents the boundary between the last read message
 // in a chat and the next unread message.
 type UnreadBoundary struct{}
@@ -81,7 +87,7 @@ type User struct {
 	// Theme specifies the name of a 9patch theme to use for messages from this
 	// user. If theme is specified it will be the preferred message surface.
 	// Empty string indicates no theme.
-	Theme Theme
+	Theme string
 	// Color to use for message bubbles of messages from this user.
 	Color color.NRGBA
 }
@@ -126,15 +132,6 @@ func (us *Users) Random() *User {
 	return &us.list[rand.Intn(len(us.list)-1)]
 }
 
-// Theme enumerates the various 9patch themes.
-type Theme int
-
-const (
-	ThemeEmpty Theme = iota
-	ThemePlatoCookie
-	ThemeHotdog
-)
-
 // Rooms structure manages a collection of rooms.
 type Rooms struct {
 	list  []Room
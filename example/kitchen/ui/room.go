@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"gioui.org/widget"
+	"git.sr.ht/~gioverse/chat/debug"
 	"git.sr.ht/~gioverse/chat/example/kitchen/appwidget"
 	"git.sr.ht/~gioverse/chat/example/kitchen/model"
 	"git.sr.ht/~gioverse/chat/list"
@@ -37,6 +38,8 @@ type Room struct {
 	// rendering what is actualy viewable.
 	// The widget.List consumes this during layout.
 	ListState *list.Manager
+	// Stats aggregates the processing statistics of ListState.
+	Stats *debug.ListStats
 	// List implements the raw scrolling, adding scrollbars and responding
 	// to mousewheel / touch fling gestures.
 	List widget.List
@@ -5,9 +5,14 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
+	"io/fs"
 	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"gioui.org/font/gofont"
@@ -21,6 +26,8 @@ import (
 	lorem "github.com/drhodes/golorem"
 
 	"git.sr.ht/~gioverse/chat/async"
+	"git.sr.ht/~gioverse/chat/async/media"
+	"git.sr.ht/~gioverse/chat/debug"
 	"git.sr.ht/~gioverse/chat/example/kitchen/appwidget/apptheme"
 	"git.sr.ht/~gioverse/chat/example/kitchen/gen"
 	"git.sr.ht/~gioverse/chat/example/kitchen/model"
@@ -50,6 +57,9 @@ type Config struct {
 	// bufferSize specifies how many elements to hold in memory before
 	// compacting the list.
 	BufferSize int
+	// Stats displays the processing statistics of the active room's list
+	// and of the image loader.
+	Stats bool
 }
 
 // th is the active theme object.
@@ -71,7 +81,7 @@ type UI struct {
 	// Loader loads resources asynchronously.
 	// Deallocates stale resources.
 	// Stale is defined as "not being scheduled frequently".
-	async.Loader
+	Loader async.TypedLoader[string, image.Image]
 	// Rooms is the root of the data, containing messages chunked by
 	// room.
 	// It also contains interact state, rather than maintaining two
@@ -104,33 +114,79 @@ type UI struct {
 	// menu is currently acting.
 	ContextMenuTarget *model.Message
 
+	// Stats displays the processing statistics of the active room's list
+	// and of the image loader.
+	Stats bool
+
 	usePlato bool
+	// scheduler limits the image downloads of the Loader, running them on
+	// pool. Both are shut down along with the UI.
+	scheduler *async.LimitedScheduler
+	pool      *async.FixedWorkerPool
+	// cacheDir holds the images cached on disk by the Loader during this
+	// run. It is removed along with the UI.
+	cacheDir string
 }
 
-// loadNinePatch from the embedded resources package.
-func loadNinePatch(path string) ninepatch.NinePatch {
-	imgf, err := res.Resources.Open(path)
+// loadThemes loads every theme within the embedded resources package, keyed
+// by the name of its manifest without the extension.
+func loadThemes() map[string]ninepatch.Theme {
+	manifests, err := fs.Glob(res.Resources, "9-Patch/*.json")
 	if err != nil {
-		panic(fmt.Errorf("opening image: %w", err))
+		panic(fmt.Errorf("listing themes: %w", err))
 	}
-	defer imgf.Close()
-	img, err := png.Decode(imgf)
-	if err != nil {
-		panic(fmt.Errorf("decoding png: %w", err))
+	themes := make(map[string]ninepatch.Theme, len(manifests))
+	for _, manifest := range manifests {
+		name := strings.TrimSuffix(path.Base(manifest), ".json")
+		theme, err := ninepatch.LoadThemeManifest(res.Resources, manifest)
+		if err != nil {
+			panic(fmt.Errorf("loading theme %q: %w", name, err))
+		}
+		themes[name] = theme
 	}
-	return ninepatch.DecodeNinePatch(img)
+	return themes
 }
 
-var (
-	cookie = loadNinePatch("9-Patch/iap_platocookie_asset_2.png")
-	hotdog = loadNinePatch("9-Patch/iap_hotdog_asset.png")
-)
+// themes are the 9patch themes available to users.
+var themes = loadThemes()
 
 // NewUI constructs a UI and populates it with dummy data.
 func NewUI(invalidator func(), conf Config) *UI {
 	var ui UI
 
 	ui.usePlato = conf.UsePlato
+	// Retry failed image downloads a few times before giving up.
+	ui.Loader.Retry = async.RetryPolicy{
+		MaxRetries: 3,
+		Backoff:    time.Second,
+		Jitter:     0.5,
+	}
+	// Images are keyed by URL. Avoid being throttled by the image hosts by
+	// limiting the concurrent downloads from each of them.
+	ui.pool = &async.FixedWorkerPool{Workers: async.DefaultMaxLoaded}
+	ui.scheduler = &async.LimitedScheduler{
+		Scheduler: ui.pool,
+		Group: func(key async.Tag) async.Tag {
+			if u, err := url.Parse(key.(string)); err == nil {
+				return u.Host
+			}
+			return key
+		},
+		MaxPerGroup: 4,
+	}
+	ui.Loader.Scheduler = ui.scheduler
+	// Keep decoded images in memory after they scroll out of view, so that
+	// scrolling back does not decode them again, and on disk so that they
+	// are not downloaded again. The images are random, so the disk cache is
+	// scoped to this run: a later run must not show the images of this one.
+	ui.Loader.Cache = &async.Cache{Codec: async.PNG}
+	if dir, err := os.MkdirTemp("", "chat-resources-"); err != nil {
+		log.Printf("creating image cache: %v", err)
+	} else {
+		ui.cacheDir = dir
+		ui.Loader.Cache.Dir = dir
+	}
+	ui.Stats = conf.Stats
 
 	switch conf.Theme {
 	case "light":
@@ -153,6 +209,10 @@ func NewUI(invalidator func(), conf Config) *UI {
 			return img
 		},
 	}
+	for name := range themes {
+		g.Themes = append(g.Themes, name)
+	}
+	sort.Strings(g.Themes)
 
 	// Generate most of the model data.
 	var (
@@ -169,6 +229,7 @@ func NewUI(invalidator func(), conf Config) *UI {
 		rt.SimulateLatency = conf.Latency
 		rt.MaxLoads = conf.LoadSize
 		rt.ScrollToEnd = false
+		stats := &debug.ListStats{}
 		lm := list.NewManager(conf.BufferSize,
 			list.Hooks{
 				// Define an allocator function that can instaniate the appropriate
@@ -189,13 +250,17 @@ func NewUI(invalidator func(), conf Config) *UI {
 				Synthesizer: synth,
 				Comparator:  rowLessThan,
 				Invalidator: invalidator,
+				Observer:    stats,
 			},
 		)
 		lm.Stickiness = list.After
+		// Chat history grows from the bottom of the room.
+		lm.Gravity = list.After
 		ui.Rooms.List = append(ui.Rooms.List, Room{
 			Room:      r,
 			Messages:  rt,
 			ListState: lm,
+			Stats:     stats,
 		})
 	}
 
@@ -234,6 +299,33 @@ func NewUI(invalidator func(), conf Config) *UI {
 	return &ui
 }
 
+// Shutdown stops the background processing of the image loader, along with
+// its scheduler, and of the list of each room, returning the first error
+// encountered.
+func (ui *UI) Shutdown(ctx context.Context) error {
+	err := ui.Loader.ShutdownContext(ctx)
+	for _, s := range []interface {
+		Shutdown(context.Context) error
+	}{ui.scheduler, ui.pool} {
+		if serr := s.Shutdown(ctx); err == nil {
+			err = serr
+		}
+	}
+	ui.Rooms.Lock()
+	defer ui.Rooms.Unlock()
+	for ii := range ui.Rooms.List {
+		if rerr := ui.Rooms.List[ii].ListState.ShutdownContext(ctx); err == nil {
+			err = rerr
+		}
+	}
+	if ui.cacheDir != "" {
+		if rerr := os.RemoveAll(ui.cacheDir); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
 // Layout the application UI.
 func (ui *UI) Layout(gtx C) D {
 	return ui.Loader.Frame(gtx, ui.layout)
@@ -314,9 +406,33 @@ func (ui *UI) layoutChat(gtx C) D {
 		Axis: layout.Vertical,
 	}.Layout(gtx,
 		layout.Flexed(1, func(gtx C) D {
-			return listStyle.Layout(gtx,
-				state.UpdatedLen(&list.List),
-				state.Layout,
+			return layout.Stack{}.Layout(gtx,
+				layout.Stacked(func(gtx C) D {
+					return listStyle.Layout(gtx,
+						state.UpdatedLen(&list.List),
+						state.Layout,
+					)
+				}),
+				layout.Expanded(func(gtx C) D {
+					// Keep the date of the messages being read pinned
+					// to the top of the list.
+					gtx.Constraints.Max.X -= gtx.Dp(scrollWidth)
+					gtx.Constraints.Min = gtx.Constraints.Constrain(gtx.Constraints.Min)
+					return state.LayoutHeader(gtx, &list.List)
+				}),
+				layout.Stacked(func(gtx C) D {
+					if !ui.Stats {
+						return D{}
+					}
+					return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+						layout.Rigid(func(gtx C) D {
+							return room.Stats.Layout(gtx, th.Theme)
+						}),
+						layout.Rigid(func(gtx C) D {
+							return debug.LoaderStats(gtx, th.Theme, ui.Loader.Stats())
+						}),
+					)
+				}),
 			)
 		}),
 		layout.Rigid(func(gtx C) D {
@@ -532,7 +648,13 @@ func (ui *UI) presentChatRow(data list.Element, state interface{}) layout.Widget
 			return ui.row(ui.usePlato, data, state)(gtx)
 		}
 	case model.DateBoundary:
-		return matchat.DateSeparator(th.Theme, data.Date).Layout
+		return func(gtx C) D {
+			// Paint the content background behind the separator so that
+			// messages don't show through while it sticks to the top of
+			// the list.
+			return chatlayout.Background(ui.Bg).Layout(gtx,
+				matchat.DateSeparator(th.Theme, data.Date).Layout)
+		}
 	case model.UnreadBoundary:
 		return matchat.UnreadSeparator(th.Theme).Layout
 	default:
@@ -547,14 +669,16 @@ func (ui *UI) row(usePlato bool, data model.Message, state *chatwidget.Row) layo
 	if !ok {
 		return func(C) D { return D{} }
 	}
-	np := func() *ninepatch.NinePatch {
-		switch user.Theme {
-		case model.ThemeHotdog:
-			return &hotdog
-		case model.ThemePlatoCookie:
-			return &cookie
+	local := user.Name == ui.Local.Name
+	bubble := func() *ninepatch.Bubble {
+		theme, ok := themes[user.Theme]
+		if !ok {
+			return nil
 		}
-		return nil
+		if local {
+			return &theme.Local
+		}
+		return &theme.Remote
 	}()
 	var (
 		avatar image.Image
@@ -580,11 +704,14 @@ func (ui *UI) row(usePlato bool, data model.Message, state *chatwidget.Row) layo
 			Content: data.Content,
 			Avatar:  avatar,
 			SentAt:  data.SentAt,
-			Local:   user.Name == ui.Local.Name,
+			Local:   local,
 		})
-		if np != nil {
-			msg.MessageStyle = msg.WithNinePatch(th.Theme, *np)
-			if cl, ok := np.Image.At(np.Bounds().Dx()/2, np.Bounds().Dy()/2).(color.NRGBA); ok {
+		if bubble != nil {
+			np := bubble.NinePatch
+			msg.MessageStyle = msg.WithNinePatch(th.Theme, np)
+			if bubble.TextColor.A > 0 {
+				msg.TextColor(bubble.TextColor)
+			} else if cl, ok := np.Image.At(np.Bounds().Dx()/2, np.Bounds().Dy()/2).(color.NRGBA); ok {
 				msg.TextColor(th.Contrast(matchat.Luminance(cl)))
 			}
 		} else {
@@ -598,10 +725,10 @@ func (ui *UI) row(usePlato bool, data model.Message, state *chatwidget.Row) layo
 		SentAt:  data.SentAt,
 		Avatar:  avatar,
 		Image:   body,
-		Local:   user.Name == ui.Local.Name,
+		Local:   local,
 	})
-	if np != nil {
-		msg.MessageStyle = msg.WithNinePatch(th.Theme, *np)
+	if bubble != nil {
+		msg.MessageStyle = msg.WithNinePatch(th.Theme, bubble.NinePatch)
 	}
 	msg.MessageStyle.BubbleStyle.Color = user.Color
 	for i := range msg.Content.Styles {
@@ -632,20 +759,20 @@ func placeholder(sz image.Point, c color.NRGBA) (ph *image.NRGBA) {
 }
 
 // loadImage helper schedules an image to be downloaded and returns it if ready.
-func loadImage(id, u string, l *async.Loader) image.Image {
-	r := l.Schedule(id, func(_ context.Context) interface{} {
-		img, err := fetch(id, u)
+// Images are keyed by their URL, so that an image displayed many times (like
+// the avatar of a user) is only downloaded once. The URLs must therefore be
+// unique to each image: the generated ones carry a signature for that.
+func loadImage(id, u string, l *async.TypedLoader[string, image.Image]) image.Image {
+	r := l.ScheduleErr(id, func(ctx context.Context) (image.Image, error) {
+		img, err := media.LoadImage(ctx, media.URL(u), image.Point{})
 		if err != nil {
 			log.Printf("loading image: %v", err)
+			return nil, err
 		}
-		return img
-	})
-	switch r.State {
-	case async.Queued, async.Loading:
-	case async.Loaded:
-		if img, ok := r.Value.(image.Image); ok {
-			return img
-		}
+		return img, nil
+	}, async.WithKey(u))
+	if r.State != async.Loaded {
+		return nil
 	}
-	return nil
+	return r.Value
 }
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"image/png"
 	"math"
 	"os"
 
@@ -103,39 +102,26 @@ type UI struct {
 	DemoContainer widget.List
 }
 
+// loadTheme from the embedded resources package. Panic on failure.
+func loadTheme(manifest string) ninepatch.Theme {
+	theme, err := ninepatch.LoadThemeManifest(res.Resources, manifest)
+	if err != nil {
+		panic(fmt.Errorf("loading theme: %w", err))
+	}
+	return theme
+}
+
 // NewUI constructs a UI and populates it with dummy data.
 func NewUI() *UI {
 	return &UI{
 		Messages: map[string]*FauxMessage{
 			"platocookie": {
-				Text: lorem.Sentence(1, 5),
-				Surface: func() ninepatch.NinePatch {
-					imgf, err := res.Resources.Open("9-Patch/iap_platocookie_asset_2.png")
-					if err != nil {
-						panic(fmt.Errorf("opening image: %w", err))
-					}
-					defer imgf.Close()
-					img, err := png.Decode(imgf)
-					if err != nil {
-						panic(fmt.Errorf("decoding png: %w", err))
-					}
-					return ninepatch.DecodeNinePatch(img)
-				}(),
+				Text:    lorem.Sentence(1, 5),
+				Surface: loadTheme("9-Patch/cookie.json").Local.NinePatch,
 			},
 			"hotdog": {
-				Text: lorem.Sentence(1, 5),
-				Surface: func() ninepatch.NinePatch {
-					imgf, err := res.Resources.Open("9-Patch/iap_hotdog_asset.png")
-					if err != nil {
-						panic(fmt.Errorf("opening image: %w", err))
-					}
-					defer imgf.Close()
-					img, err := png.Decode(imgf)
-					if err != nil {
-						panic(fmt.Errorf("decoding png: %w", err))
-					}
-					return ninepatch.DecodeNinePatch(img)
-				}(),
+				Text:    lorem.Sentence(1, 5),
+				Surface: loadTheme("9-Patch/hotdog.json").Local.NinePatch,
 			},
 		},
 		Toggles: []struct {
@@ -2,6 +2,7 @@ package list
 
 import (
 	"fmt"
+	"time"
 )
 
 type updateType uint8
@@ -32,7 +33,8 @@ func (u updateType) String() string {
 // within the new data.
 type stateUpdate struct {
 	Synthesis
-	// CompactedSerials is a slice of Serials that were compacted within this update.
+	// CompactedSerials is a slice of Serials that were compacted or removed
+	// within this update.
 	CompactedSerials []Serial
 	// Ignore reports which directions (if any) the async backend currently
 	// believes to have no new content.
@@ -49,124 +51,232 @@ type viewport struct {
 	Start, End Serial
 }
 
+// processor holds the state of the element processing performed on behalf of
+// a Manager, and applies requests to it one at a time.
+type processor struct {
+	hooks     Hooks
+	compact   *Compact
+	synthesis Synthesis
+	viewport  viewport
+	ignore    Direction
+	// updates is the number of state updates produced so far.
+	updates int
+	// recorder, if not nil, records each processed request.
+	recorder *Recorder
+}
+
+func newProcessor(maxSize int, hooks Hooks) *processor {
+	return &processor{
+		hooks:   hooks,
+		compact: NewCompact(maxSize, hooks.Comparator),
+	}
+}
+
+// process applies req to the state of the processor. pollViewport is invoked
+// to check for a new viewport prior to compaction. If the request changed
+// nothing, ok will be false.
+func (p *processor) process(req interface{}, pollViewport func() (viewport, bool)) (su stateUpdate, ok bool) {
+	var (
+		newElems   []Element
+		updateOnly []Element
+		rmSerials  []Serial
+		event      TraceEvent
+	)
+	switch req := req.(type) {
+	case recordRequest:
+		p.record(req.recorder)
+		close(req.done)
+		return su, false
+	case modificationRequest:
+		if len(req.NewOrUpdate) == 0 && len(req.UpdateOnly) == 0 && len(req.Remove) == 0 {
+			// Nothing to change.
+			return su, false
+		}
+		su.Type = push
+		newElems = req.NewOrUpdate
+		rmSerials = req.Remove
+		updateOnly = req.UpdateOnly
+		if p.recorder != nil {
+			event = TraceEvent{
+				Kind:       TraceModify,
+				Elements:   p.recorder.encode(newElems),
+				UpdateOnly: p.recorder.encode(updateOnly),
+				Remove:     rmSerials,
+			}
+		}
+
+		/*
+			Remove any elements that sort outside the boundaries of the
+			current list.
+		*/
+		SliceFilter(&newElems, func(elem Element) bool {
+			if len(p.synthesis.Source) == 0 {
+				return true
+			}
+			sortsBefore := p.compact.Comparator(elem, p.synthesis.Source[0])
+			sortsAfter := p.compact.Comparator(p.synthesis.Source[len(p.synthesis.Source)-1], elem)
+			// If this element sorts before the beginning of the list or after
+			// the end of the list, it should not be inserted unless we are at
+			// the appropriate end of the list.
+			switch {
+			case sortsBefore && p.ignore == Before:
+				return true
+			case sortsAfter && p.ignore == After:
+				return true
+			case sortsBefore || sortsAfter:
+				return false
+			default:
+				return true
+			}
+		})
+		p.ignore = NoDirection
+	case loadRequest:
+		su.Type = pull
+		p.viewport = req.viewport
+		if p.ignore.Contains(req.Direction) {
+			return su, false
+		}
+
+		// Find the serial of the element at either end of the list.
+		var loadSerial Serial
+		switch req.Direction {
+		case Before:
+			loadSerial = p.synthesis.SerialAt(0)
+		case After:
+			loadSerial = p.synthesis.SerialAt(len(p.synthesis.Source) - 1)
+		}
+		// Load new elements.
+		var more bool
+		start := time.Now()
+		newElems, more = p.hooks.Loader(req.Direction, loadSerial)
+		p.observe(Metric{
+			Kind:      LoadMetric,
+			Direction: req.Direction,
+			Duration:  time.Since(start),
+			Count:     len(newElems),
+		})
+		// Track whether all new elements in a given direction have been
+		// exhausted.
+		if len(newElems) == 0 || !more {
+			p.ignore.Add(req.Direction)
+		} else {
+			p.ignore = NoDirection
+		}
+		if p.recorder != nil {
+			event = TraceEvent{
+				Kind:       TraceLoad,
+				Direction:  req.Direction,
+				RelativeTo: loadSerial,
+				Elements:   p.recorder.encode(newElems),
+				More:       more,
+			}
+		}
+	}
+	// Apply state updates.
+	p.compact.Apply(newElems, updateOnly, rmSerials)
+
+	// Update the viewport if there is a new one available.
+	if viewport, ok := pollViewport(); ok {
+		p.viewport = viewport
+	}
+
+	// Fetch new contents and list of compacted content.
+	contents, compacted := p.compact.Compact(p.viewport.Start, p.viewport.End)
+	p.observe(Metric{Kind: CompactMetric, Count: len(compacted)})
+	// Removed elements need their state discarded just like compacted
+	// ones.
+	su.CompactedSerials = append(compacted, rmSerials...)
+	// Synthesize elements based on new contents.
+	start := time.Now()
+	p.synthesis = Synthesize(contents, p.hooks.Synthesizer)
+	p.observe(Metric{
+		Kind:     SynthesisMetric,
+		Duration: time.Since(start),
+		Count:    len(p.synthesis.Elements),
+	})
+	su.Synthesis = p.synthesis
+	su.Ignore = p.ignore
+	p.updates++
+
+	if p.recorder != nil {
+		event.Update = p.updates
+		event.Start, event.End = p.viewport.Start, p.viewport.End
+		event.Synthesized = serialsOf(p.synthesis.Elements)
+		event.Compacted = su.CompactedSerials
+		p.recorder.add(event)
+	}
+	return su, true
+}
+
+// observe reports m to the Observer hook, if any.
+func (p *processor) observe(m Metric) {
+	if p.hooks.Observer != nil {
+		p.hooks.Observer.Observe(m)
+	}
+}
+
+// record starts recording the requests processed into r, beginning with a
+// snapshot of the current state. A nil r stops recording.
+func (p *processor) record(r *Recorder) {
+	p.recorder = r
+	p.recorder.add(TraceEvent{
+		Kind:        TraceStart,
+		Update:      p.updates,
+		MaxSize:     p.compact.Size,
+		Elements:    p.recorder.encode(p.synthesis.Source),
+		Ignore:      p.ignore,
+		Start:       p.viewport.Start,
+		End:         p.viewport.End,
+		Synthesized: serialsOf(p.synthesis.Elements),
+	})
+}
+
 // asyncProcess runs a list.processor concurrently.
 // New elements are processed and compacted according to maxSize
 // on each loadRequest. Close the loadRequest channel to terminate
-// processing.
-func asyncProcess(maxSize int, hooks Hooks) (chan<- interface{}, chan viewport, <-chan []stateUpdate) {
-	compact := NewCompact(maxSize, hooks.Comparator)
-	var synthesis Synthesis
+// processing. The returned done channel is closed once processing has
+// terminated.
+func asyncProcess(maxSize int, hooks Hooks) (chan<- interface{}, chan viewport, <-chan []stateUpdate, <-chan struct{}) {
+	p := newProcessor(maxSize, hooks)
 	reqChan := make(chan interface{})
 	updateChan := make(chan []stateUpdate, 1)
 	viewports := make(chan viewport, 1)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		defer close(updateChan)
-		var (
-			viewport viewport
-			ignore   Direction
-		)
-		for {
-			var (
-				su         stateUpdate
-				newElems   []Element
-				updateOnly []Element
-				rmSerials  []Serial
-			)
-			select {
-			case req, more := <-reqChan:
-				if !more {
-					return
-				}
-				switch req := req.(type) {
-				case modificationRequest:
-					su.Type = push
-					newElems = req.NewOrUpdate
-					rmSerials = req.Remove
-					updateOnly = req.UpdateOnly
-
-					/*
-						Remove any elements that sort outside the boundaries of the
-						current list.
-					*/
-					SliceFilter(&newElems, func(elem Element) bool {
-						if len(synthesis.Source) == 0 {
-							return true
-						}
-						sortsBefore := compact.Comparator(elem, synthesis.Source[0])
-						sortsAfter := compact.Comparator(synthesis.Source[len(synthesis.Source)-1], elem)
-						// If this element sorts before the beginning of the list or after
-						// the end of the list, it should not be inserted unless we are at
-						// the appropriate end of the list.
-						switch {
-						case sortsBefore && ignore == Before:
-							return true
-						case sortsAfter && ignore == After:
-							return true
-						case sortsBefore || sortsAfter:
-							return false
-						default:
-							return true
-						}
-					})
-					ignore = NoDirection
-				case loadRequest:
-					su.Type = pull
-					viewport = req.viewport
-					if ignore.Contains(req.Direction) {
-						continue
-					}
-
-					// Find the serial of the element at either end of the list.
-					var loadSerial Serial
-					switch req.Direction {
-					case Before:
-						loadSerial = synthesis.SerialAt(0)
-					case After:
-						loadSerial = synthesis.SerialAt(len(synthesis.Source) - 1)
-					}
-					// Load new elements.
-					var more bool
-					newElems, more = hooks.Loader(req.Direction, loadSerial)
-					// Track whether all new elements in a given direction have been
-					// exhausted.
-					if len(newElems) == 0 || !more {
-						ignore.Add(req.Direction)
-					} else {
-						ignore = NoDirection
-					}
-				}
-			}
-			// Apply state updates.
-			compact.Apply(newElems, updateOnly, rmSerials)
-
-			// Update the viewport if there is a new one available.
+		pollViewport := func() (viewport, bool) {
 			select {
-			case viewport = <-viewports:
+			case viewport := <-viewports:
+				return viewport, true
 			default:
+				return viewport{}, false
+			}
+		}
+		for req := range reqChan {
+			su, ok := p.process(req, pollViewport)
+			if !ok {
+				continue
 			}
-
-			// Fetch new contents and list of compacted content.
-			contents, compacted := compact.Compact(viewport.Start, viewport.End)
-			su.CompactedSerials = compacted
-			// Synthesize elements based on new contents.
-			synthesis = Synthesize(contents, hooks.Synthesizer)
-			su.Synthesis = synthesis
-			su.Ignore = ignore
 
 			// Try send update. If the widget is not being actively laid out,
 			// we don't want to block.
+			pending := []stateUpdate{su}
 			select {
-			case updateChan <- []stateUpdate{su}:
-			default:
-				// Append latest update to the list.
-				su := su
-				pending := <-updateChan
-				pending = append(pending, su)
+			case updateChan <- pending:
+			case prev := <-updateChan:
+				// Append latest update to the list. Receiving it, rather
+				// than waiting for it after failing to send, ensures that
+				// this never blocks if the widget takes the pending updates
+				// in the meantime.
+				pending = append(prev, su)
 				updateChan <- pending
 			}
+			p.observe(Metric{Kind: BatchMetric, Count: len(pending)})
 
 			hooks.Invalidator()
+			p.observe(Metric{Kind: InvalidateMetric})
 		}
 	}()
-	return reqChan, viewports, updateChan
+	return reqChan, viewports, updateChan, done
 }
@@ -34,7 +34,7 @@ func TestAsyncProcess(t *testing.T) {
 		},
 	}
 	size := 6
-	reqs, _, updates := asyncProcess(size, hooks)
+	reqs, _, updates, _ := asyncProcess(size, hooks)
 
 	type testcase struct {
 		// description of what this test case is checking
@@ -322,7 +322,7 @@ func TestCanModifyWhenIdle(t *testing.T) {
 		// at the beginning or end of the list.
 		return false
 	}
-	requests, viewports, updates := asyncProcess(4, hooks)
+	requests, viewports, updates, _ := asyncProcess(4, hooks)
 
 	viewports <- viewport{
 		Start: "0",
@@ -388,3 +388,43 @@ func TestCanModifyWhenIdle(t *testing.T) {
 		t.Fatalf("expected 4 pending updates, got %d", total)
 	}
 }
+
+// TestObserver ensures that the processing of a request is reported to the
+// Observer hook.
+func TestObserver(t *testing.T) {
+	var metrics []Metric
+	hooks := testHooks
+	hooks.Synthesizer = testSynthesizer
+	hooks.Loader = func(dir Direction, rt Serial) ([]Element, bool) {
+		return testElements[:3], false
+	}
+	hooks.Observer = ObserverFunc(func(m Metric) {
+		metrics = append(metrics, m)
+	})
+	requests, _, updates, _ := asyncProcess(4, hooks)
+	requests <- loadRequest{Direction: After}
+	<-updates
+	close(requests)
+	// Wait for the processing goroutine to exit, guaranteeing that it
+	// observed everything.
+	for range updates {
+	}
+
+	expected := []Metric{
+		{Kind: LoadMetric, Direction: After, Count: 3},
+		{Kind: CompactMetric},
+		{Kind: SynthesisMetric, Count: 3},
+		{Kind: BatchMetric, Count: 1},
+		{Kind: InvalidateMetric},
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("expected %d metrics, got %v", len(expected), metrics)
+	}
+	for i := range expected {
+		got := metrics[i]
+		got.Duration = 0
+		if got != expected[i] {
+			t.Errorf("metric %d: expected %+v, got %+v", i, expected[i], got)
+		}
+	}
+}
@@ -77,6 +77,7 @@ func (c *Compact) Apply(insertOrUpdate []Element, updateOnly []Element, remove [
 }
 
 // Compact returns a compacted slice of the elements managed by the Compact.
+// The slice is never modified by the Compact afterwards.
 // The resulting elements are garanteed to be sorted using the
 // Compact's Comparator and there will usually be no more than c.Size elements.
 // The exception is when c.Size is smaller than 3 times the distance between
@@ -133,5 +134,10 @@ func (c *Compact) Compact(keepStart, keepEnd Serial) (contents []Element, compac
 	copy(newRaw, c.elements[keepStartIdx:keepEndIdx+1])
 	c.elements = newRaw
 
-	return c.elements, compacted
+	// Return a copy of the contents: later calls to Apply sort c.elements in
+	// place, while the contents may be in use elsewhere (such as by the
+	// Manager on the layout goroutine).
+	contents = make([]Element, newLength)
+	copy(contents, c.elements)
+	return contents, compacted
 }
@@ -26,6 +26,22 @@ type Element interface {
 	Serial() Serial
 }
 
+// Header is an optional interface that Elements (usually synthesized ones)
+// can implement to mark themselves as section headers. While the list is
+// scrolled past a header, Manager.LayoutHeader will keep presenting it at
+// the top of the viewport until the next header pushes it away.
+type Header interface {
+	Element
+	// IsHeader reports whether the element starts a new section.
+	IsHeader() bool
+}
+
+// isHeader reports whether elem is a section header.
+func isHeader(elem Element) bool {
+	h, ok := elem.(Header)
+	return ok && h.IsHeader()
+}
+
 // Start is a psuedo Element that indicates the beginning of the list view,
 // that is, the beginning of the elements currently loaded in memory.
 // Type assert inside Synthesizer to check for list boundary.
@@ -93,6 +109,9 @@ type Hooks struct {
 	// Invalidator triggers a new frame in the window displaying the managed
 	// list.
 	Invalidator func()
+	// Observer, if not nil, receives metrics describing the processing of
+	// the managed list. See debug.ListStats for an Observer displaying them.
+	Observer Observer
 }
 
 type defaultElement struct {
@@ -234,6 +253,14 @@ type modificationRequest struct {
 	Remove      []Serial
 }
 
+// recordRequest represents a request to start (or stop, if recorder is nil)
+// recording the requests processed for the list.
+type recordRequest struct {
+	recorder *Recorder
+	// done is closed once recording has started.
+	done chan struct{}
+}
+
 // SliceRemove takes the given index of a slice and swaps it with the final
 // index in the slice, then shortens the slice by one element. This hides
 // the element at index from the slice, though it does not erase its data.
@@ -1,11 +1,15 @@
 package list
 
 import (
+	"context"
 	"fmt"
+	"image"
 	"math"
 	"sync"
 
 	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/clip"
 )
 
 // Manager presents heterogenous Element data. Each element could represent
@@ -45,6 +49,19 @@ type Manager struct {
 	// will make both ends sticky.
 	Stickiness Direction
 
+	// Gravity specifies the end of the viewport that the list content is
+	// anchored to. Setting this field to "After" produces a bottom-up list
+	// (as is typical of chat history): content too short to fill the viewport
+	// is aligned with the end of the viewport, the position of the viewport
+	// is preserved relative to its last visible element, and content pushed
+	// to the end of the list while the end is visible pushes older content
+	// towards the beginning of the list. The Manager controls the
+	// ScrollToEnd field of the list in this mode.
+	//
+	// The default of NoDirection (like "Before") anchors content to the start
+	// of the viewport. Stickiness behaves the same regardless of Gravity.
+	Gravity Direction
+
 	// elements is the list of data to present and some useful metadata
 	// mappings for it.
 	elements Synthesis
@@ -69,6 +86,11 @@ type Manager struct {
 	// by the manager.
 	elementState map[Serial]interface{}
 
+	// sizes records the dimensions of each element laid out during the
+	// current frame, keyed by element index. It is used to position the
+	// sticky section header.
+	sizes map[int]image.Point
+
 	// requests is a blocking channel of LoadRequests. Requests sent on this
 	// channel will be picked up by the state management goroutine, and
 	// the results will be available as data on the stateUpdates channel.
@@ -85,8 +107,17 @@ type Manager struct {
 	viewports    chan viewport
 	lastPosition layout.Position
 
+	// updates is the number of state updates applied to the list.
+	updates int
+	// recorder records the positions of the list, if set by Record.
+	recorder *Recorder
+	// recording synchronizes access to recorder.
+	recording sync.Mutex
+
 	// shutdown ensures that the Manager is only shut down once.
 	shutdown sync.Once
+	// done is closed once the state management goroutine has exited.
+	done <-chan struct{}
 }
 
 // tryRequest will send the loadRequest if and only if the background processing
@@ -115,6 +146,16 @@ func (m *Manager) updateViewport(pos layout.Position) {
 	}
 	m.lastPosition = pos
 	m.viewport.Start, m.viewport.End = m.elements.ViewportToSerials(pos)
+	m.recording.Lock()
+	recorder := m.recorder
+	m.recording.Unlock()
+	recorder.add(TraceEvent{
+		Kind:     TracePosition,
+		Update:   m.updates,
+		Position: &pos,
+		Start:    m.viewport.Start,
+		End:      m.viewport.End,
+	})
 	// Try to send the viewport until we succeed. This should only ever
 	// iterate a maximum of twice.
 	for {
@@ -153,14 +194,24 @@ func NewManager(maxSize int, hooks Hooks) *Manager {
 		maxSize:      maxSize,
 	}
 
-	rm.requests, rm.viewports, rm.stateUpdates = asyncProcess(maxSize, hooks)
+	rm.requests, rm.viewports, rm.stateUpdates, rm.done = asyncProcess(maxSize, hooks)
 
 	return rm
 }
 
-// Shutdown kills the asynchronous goroutine powering the list. After this, the
-// Manager can no longer be used.
+// Shutdown kills the asynchronous goroutine powering the list, and waits for
+// it to exit (see ShutdownContext). After this, the Manager can no longer be
+// used.
 func (m *Manager) Shutdown() {
+	m.ShutdownContext(context.Background())
+}
+
+// ShutdownContext stops the asynchronous goroutine powering the list, and
+// waits for it to exit. The goroutine first finishes processing the current
+// request, if any, which may involve waiting for the Loader hook to return.
+// If ctx is done first, ShutdownContext returns ctx.Err() and the goroutine
+// exits in the background. After this, the Manager can no longer be used.
+func (m *Manager) ShutdownContext(ctx context.Context) error {
 	m.shutdown.Do(func() {
 		if m.requests != nil {
 			// Check if nil because some test cases override this channel with
@@ -168,6 +219,15 @@ func (m *Manager) Shutdown() {
 			close(m.requests)
 		}
 	})
+	if m.done == nil {
+		return nil
+	}
+	select {
+	case <-m.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // DefaultPrefetch is the default prefetching threshold.
@@ -185,7 +245,8 @@ const DefaultPrefetch = 0.15
 // the managed list.
 //
 // Elements that sort outside of the view will be ignored. In that case the
-// loader hook should load it when scrolled into view.
+// loader hook should load it when scrolled into view. Empty modifications are
+// ignored as well.
 //
 // This method may block, and should not be called from the goroutine that
 // is performing layout.
@@ -238,6 +299,19 @@ func (m *Manager) Remove(remove []Serial) {
 	}
 }
 
+// Record starts recording a trace of the requests processed by the Manager
+// and of the positions of the list displaying it into r, beginning with a
+// snapshot of the elements currently held by the Manager. Passing a nil
+// Recorder stops recording. See Replay.
+func (m *Manager) Record(r *Recorder) {
+	done := make(chan struct{})
+	m.requests <- recordRequest{recorder: r, done: done}
+	<-done
+	m.recording.Lock()
+	defer m.recording.Unlock()
+	m.recorder = r
+}
+
 // Layout the element at the given index.
 func (m *Manager) Layout(gtx layout.Context, index int) layout.Dimensions {
 	if index < 0 {
@@ -286,15 +360,129 @@ func (m *Manager) Layout(gtx layout.Context, index int) layout.Dimensions {
 		m.tryRequest(After)
 	}
 	// Lay out the element for the current index.
-	data := m.elements.Elements[index]
+	dims := m.present(m.elements.Elements[index])(gtx)
+	if m.sizes == nil {
+		m.sizes = make(map[int]image.Point)
+	}
+	m.sizes[index] = dims.Size
+	return dims
+}
+
+// present returns the widget for the given element, allocating state for
+// it if necessary.
+func (m *Manager) present(data Element) layout.Widget {
 	id := data.Serial()
 	state, ok := m.elementState[id]
 	if !ok && id != NoSerial {
 		state = m.hooks.Allocator(data)
 		m.elementState[id] = state
 	}
-	widget := m.hooks.Presenter(data, state)
-	return widget(gtx)
+	return m.hooks.Presenter(data, state)
+}
+
+// LayoutHeader lays out the section header (see Header) that the viewport
+// of the provided list is currently scrolled into, anchored to the start of
+// the viewport. If the next header is visible and overlaps the current one,
+// the current header is pushed out of the viewport by it.
+//
+// LayoutHeader must be called after the list has been laid out during the
+// frame, and is intended to be stacked atop the list:
+//
+//	layout.Stack{}.Layout(gtx,
+//		layout.Stacked(func(gtx C) D {
+//			return list.Layout(gtx, m.UpdatedLen(&list), m.Layout)
+//		}),
+//		layout.Expanded(func(gtx C) D {
+//			return m.LayoutHeader(gtx, &list)
+//		}),
+//	)
+func (m *Manager) LayoutHeader(gtx layout.Context, list *layout.List) layout.Dimensions {
+	pos := list.Position
+	if pos.First >= len(m.elements.Elements) {
+		return layout.Dimensions{}
+	}
+	current, next := m.elements.HeaderAt(pos.First)
+	if current < 0 || (current == pos.First && pos.Offset <= 0) {
+		// Either the first section has not started yet, or its header is
+		// already fully visible in its natural position.
+		return layout.Dimensions{}
+	}
+	// Let the header choose its own size along the main axis.
+	minimum := list.Axis.Convert(gtx.Constraints.Min)
+	minimum.X = 0
+	gtx.Constraints.Min = list.Axis.Convert(minimum)
+
+	macro := op.Record(gtx.Ops)
+	dims := m.present(m.elements.Elements[current])(gtx)
+	call := macro.Stop()
+
+	// If the next header has scrolled into the space occupied by this one,
+	// push this one out of the way.
+	var push int
+	if start, ok := m.startOf(list, next); ok {
+		if extent := list.Axis.Convert(dims.Size).X; start < extent {
+			push = start - extent
+		}
+	}
+	defer clip.Rect{Max: dims.Size}.Push(gtx.Ops).Pop()
+	defer op.Offset(list.Axis.Convert(image.Pt(push, 0))).Push(gtx.Ops).Pop()
+	call.Add(gtx.Ops)
+	return dims
+}
+
+// forgetSizes discards the element sizes recorded during layout.
+func (m *Manager) forgetSizes() {
+	for index := range m.sizes {
+		delete(m.sizes, index)
+	}
+}
+
+// anchorEnd positions list such that the last visible element of the
+// previous frame that is also present in next keeps the position of its
+// leading edge within the viewport. It returns false if no such element
+// could be found.
+func (m *Manager) anchorEnd(list *layout.List, next Synthesis) bool {
+	pos := list.Position
+	last := min(pos.First+pos.Count, len(m.elements.Elements)) - 1
+	for i := last; i >= pos.First && i >= 0; i-- {
+		serial := m.elements.Elements[i].Serial()
+		if serial == NoSerial {
+			continue
+		}
+		index, ok := next.SerialToIndex[serial]
+		if !ok {
+			continue
+		}
+		start, ok := m.startOf(list, i)
+		if !ok {
+			continue
+		}
+		list.Position.First = index
+		list.Position.Offset = -start
+		return true
+	}
+	return false
+}
+
+// startOf returns the distance along the main axis of list from the start of
+// the viewport to the element at index. It returns false if that element was
+// not laid out during the current frame.
+func (m *Manager) startOf(list *layout.List, index int) (int, bool) {
+	if index < list.Position.First {
+		return 0, false
+	}
+	start := -list.Position.Offset
+	for i := list.Position.First; i < index; i++ {
+		sz, ok := m.sizes[i]
+		if !ok {
+			return 0, false
+		}
+		start += list.Axis.Convert(sz).X
+	}
+	if _, ok := m.sizes[index]; !ok {
+		return 0, false
+	}
+	return start, true
 }
 
 // UpdatedLen returns the number of elements managed by this manager, and also updates
@@ -305,6 +493,11 @@ func (m *Manager) Layout(gtx layout.Context, index int) layout.Dimensions {
 // Manager will attempt to respect that when handling content inserted
 // asynchronously with Modify() (and similar methods).
 func (m *Manager) UpdatedLen(list *layout.List) int {
+	bottomUp := m.Gravity == After
+	if bottomUp {
+		// Align short content with the end of the viewport.
+		list.ScrollToEnd = true
+	}
 	// Update the state of the manager in response to any loads.
 	select {
 	case pending := <-m.stateUpdates:
@@ -345,10 +538,16 @@ func (m *Manager) UpdatedLen(list *layout.List) int {
 				lastElementVisible := list.Position.First+list.Position.Count == len(m.elements.Elements)
 				stickToEnd = stickToEnd || (lastElementVisible && m.Stickiness.Contains(After) && (m.ignoring.Contains(After) || su.Type == push))
 				stickToBeginning = stickToBeginning || (firstElementVisible && m.Stickiness.Contains(Before) && (m.ignoring.Contains(Before) || su.Type == push))
+				// New content pushed onto the end of a bottom-up list pushes
+				// older content out of the way when the end is visible.
+				stickToEnd = stickToEnd || (lastElementVisible && bottomUp && su.Type == push)
 
 				if !stickToBeginning {
-					// Update the list position to match the new set of elements.
-					list.Position.First = newStartIndex
+					// Update the list position to match the new set of elements,
+					// anchoring bottom-up lists on their last visible element.
+					if !bottomUp || !m.anchorEnd(list, su.Synthesis) {
+						list.Position.First = newStartIndex
+					}
 				} else {
 					list.Position.First = 0
 					list.Position.Offset = 0
@@ -369,7 +568,11 @@ func (m *Manager) UpdatedLen(list *layout.List) int {
 				}
 			}
 			m.elements = su.Synthesis
-			// Delete the persistent widget state for any compacted element.
+			m.updates++
+			// Element sizes are recorded by index, and are no longer accurate
+			// for the new elements.
+			m.forgetSizes()
+			// Delete the persistent widget state for any compacted or removed element.
 			for _, serial := range su.CompactedSerials {
 				delete(m.elementState, serial)
 			}
@@ -379,6 +582,8 @@ func (m *Manager) UpdatedLen(list *layout.List) int {
 		}
 	default:
 	}
+	// Forget the element sizes from the previous frame.
+	m.forgetSizes()
 	if len(m.elements.Elements) == 0 {
 		// Push an initial request to populate the first few messages.
 		m.tryRequest(After)
@@ -1,6 +1,7 @@
 package list
 
 import (
+	"context"
 	"image"
 	"runtime"
 	"strconv"
@@ -102,7 +103,7 @@ func TestManager(t *testing.T) {
 			sendUpdate: true,
 			update: func() stateUpdate {
 				// Send an update to provide a few elements to work with.
-				persistentElements = testElements[0:3]
+				persistentElements = testElements[0:3:3]
 				return mkStateUpdate(persistentElements, synth)
 			}(),
 			expectedAllocations:   3,
@@ -465,7 +466,7 @@ func TestManagerViewportOnRemoval(t *testing.T) {
 			name:       "remove first visible element",
 			sendUpdate: true,
 			update: func() stateUpdate {
-				persistentElements = dupSlice(append(testElements[0:2], testElements[3:]...))
+				persistentElements = dupSlice(append(testElements[0:2:2], testElements[3:]...))
 				return mkStateUpdate(persistentElements, synth)
 			}(),
 			startFirstIndex: 2,
@@ -607,6 +608,36 @@ func TestManagerGC(t *testing.T) {
 	}
 }
 
+// TestManagerShutdown ensures that ShutdownContext waits for the async goroutine to
+// finish processing the current request and exit, unless its context is done
+// first.
+func TestManagerShutdown(t *testing.T) {
+	hooks := testHooks
+	invalidating, release := make(chan struct{}), make(chan struct{})
+	hooks.Invalidator = func() {
+		close(invalidating)
+		<-release
+	}
+	m := NewManager(10, hooks)
+	go m.Update([]Element{testElement{serial: "a"}})
+	<-invalidating
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.ShutdownContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected ShutdownContext to time out while processing, got %v", err)
+	}
+	close(release)
+	if err := m.ShutdownContext(context.Background()); err != nil {
+		t.Errorf("expected ShutdownContext to succeed once processed, got %v", err)
+	}
+	select {
+	case <-m.done:
+	default:
+		t.Errorf("expected the async goroutine to have exited")
+	}
+}
+
 // goroutineRunning returns whether a goroutine is currently executing
 // within the provided function name. It only checks the first 100
 // goroutines, and it does not differentiate between a goroutine
@@ -632,3 +663,294 @@ func goroutineRunning(name string) bool {
 	}
 	return false
 }
+
+// testHeader is a section header element for testing.
+type testHeader struct {
+	serial string
+}
+
+func (h testHeader) Serial() Serial {
+	return Serial(h.serial)
+}
+
+func (h testHeader) IsHeader() bool {
+	return true
+}
+
+// TestManagerStickyHeader ensures that the header of the section at the
+// start of the viewport is laid out atop the list, and that it is pushed
+// away by the next header.
+func TestManagerStickyHeader(t *testing.T) {
+	var (
+		ops op.Ops
+		gtx = layout.NewContext(&ops, system.FrameEvent{
+			Now: time.Now(),
+			Metric: unit.Metric{
+				PxPerDp: 1,
+				PxPerSp: 1,
+			},
+			Size: image.Pt(10, 10),
+		})
+		presented Element
+	)
+	hooks := testHooks
+	hooks.Presenter = func(e Element, state interface{}) layout.Widget {
+		presented = e
+		return layout.Spacer{
+			Width:  unit.Dp(5),
+			Height: unit.Dp(5),
+		}.Layout
+	}
+	elements := []Element{
+		testHeader{serial: "h0"},
+		testElement{serial: "a"},
+		testElement{serial: "b"},
+		testHeader{serial: "h1"},
+		testElement{serial: "c"},
+		testElement{serial: "d"},
+		testElement{serial: "e"},
+		testElement{serial: "f"},
+	}
+	for _, tc := range []struct {
+		name string
+		// position to lay the list out at.
+		first, offset int
+		// expected header to be presented, nil if none.
+		header Element
+		// expected distance from the start of the viewport to the next
+		// header, if it was laid out.
+		nextStart   int
+		nextLaidOut bool
+	}{
+		{
+			name:   "header in natural position",
+			first:  0,
+			header: nil,
+		},
+		{
+			name:        "header partially scrolled away",
+			first:       0,
+			offset:      2,
+			header:      elements[0],
+			nextStart:   13,
+			nextLaidOut: true,
+		},
+		{
+			name:        "next header approaching",
+			first:       2,
+			offset:      2,
+			header:      elements[0],
+			nextStart:   3,
+			nextLaidOut: true,
+		},
+		{
+			name:   "second section",
+			first:  5,
+			header: elements[3],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := Manager{
+				hooks:        hooks,
+				stateUpdates: make(chan []stateUpdate, 1),
+				viewports:    make(chan viewport, 1),
+				elementState: make(map[Serial]interface{}),
+				elements: Synthesize(elements, func(_, x, _ Element) []Element {
+					return []Element{x}
+				}),
+			}
+			list := layout.List{
+				Axis: layout.Vertical,
+				Position: layout.Position{
+					BeforeEnd: true,
+					First:     tc.first,
+					Offset:    tc.offset,
+				},
+			}
+			list.Layout(gtx, m.UpdatedLen(&list), m.Layout)
+			presented = nil
+			m.LayoutHeader(gtx, &list)
+			if presented != tc.header {
+				t.Errorf("expected header %v, got %v", tc.header, presented)
+			}
+			_, next := m.elements.HeaderAt(list.Position.First)
+			start, ok := m.startOf(&list, next)
+			if ok != tc.nextLaidOut {
+				t.Fatalf("expected next header laid out: %v, got %v", tc.nextLaidOut, ok)
+			}
+			if ok && start != tc.nextStart {
+				t.Errorf("expected next header at %d, got %d", tc.nextStart, start)
+			}
+		})
+	}
+}
+
+// TestManagerGravity ensures that a bottom-up Manager aligns short content
+// with the end of the viewport and preserves the position of the end of the
+// viewport as content changes.
+func TestManagerGravity(t *testing.T) {
+	var ops op.Ops
+	gtx := layout.NewContext(&ops, system.FrameEvent{
+		Now: time.Now(),
+		Metric: unit.Metric{
+			PxPerDp: 1,
+			PxPerSp: 1,
+		},
+		// Four elements fit in the viewport.
+		Size: image.Pt(10, 20),
+	})
+	var list layout.List
+	list.Axis = layout.Vertical
+	synth := func(a, b, c Element) []Element { return []Element{b} }
+
+	m := NewManager(20, testHooks)
+	m.Gravity = After
+	// Shut down the existing background processing for this manager.
+	close(m.requests)
+
+	// Replace the background processing channels with channels we can control
+	// from within the test.
+	updates := make(chan []stateUpdate, 1)
+	m.requests = nil
+	m.stateUpdates = updates
+
+	update := func(elements []Element, kind updateType) stateUpdate {
+		su := mkStateUpdate(dupSlice(elements), synth)
+		su.Type = kind
+		return su
+	}
+
+	for _, tc := range []struct {
+		name   string
+		update stateUpdate
+		// expected position after layout.
+		first, offset int
+		beforeEnd     bool
+	}{
+		{
+			name:   "short content is aligned with the end",
+			update: update(testElements[4:6], pull),
+			first:  0,
+			offset: -10,
+		},
+		{
+			name:   "pushed content fills the viewport",
+			update: update(testElements[4:8], push),
+			first:  0,
+			offset: 0,
+		},
+		{
+			name:   "pushed content pushes older content towards the start",
+			update: update(testElements[4:10], push),
+			first:  2,
+			offset: 0,
+		},
+		{
+			name:      "content loaded after the end does not move the viewport",
+			update:    update(append(dupSlice(testElements[4:10]), testElement{serial: "010", synthCount: 1}), pull),
+			first:     2,
+			offset:    0,
+			beforeEnd: true,
+		},
+		{
+			name:      "content loaded before the start does not move the viewport",
+			update:    update(append(dupSlice(testElements[2:10]), testElement{serial: "010", synthCount: 1}), pull),
+			first:     4,
+			offset:    0,
+			beforeEnd: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			updates <- []stateUpdate{tc.update}
+			list.Layout(gtx, m.UpdatedLen(&list), m.Layout)
+			if list.Position.First != tc.first || list.Position.Offset != tc.offset {
+				t.Errorf("expected position (%d, %d), got (%d, %d)",
+					tc.first, tc.offset, list.Position.First, list.Position.Offset)
+			}
+			if list.Position.BeforeEnd != tc.beforeEnd {
+				t.Errorf("expected BeforeEnd %v, got %v", tc.beforeEnd, list.Position.BeforeEnd)
+			}
+		})
+	}
+}
+
+// TestManagerGravityBatched ensures that a bottom-up Manager preserves the
+// position of the end of the viewport when several state updates are applied
+// within a single frame.
+func TestManagerGravityBatched(t *testing.T) {
+	var ops op.Ops
+	gtx := layout.NewContext(&ops, system.FrameEvent{
+		Now: time.Now(),
+		Metric: unit.Metric{
+			PxPerDp: 1,
+			PxPerSp: 1,
+		},
+		Size: image.Pt(10, 20),
+	})
+	var list layout.List
+	list.Axis = layout.Vertical
+	synth := func(a, b, c Element) []Element { return []Element{b} }
+
+	hooks := testHooks
+	hooks.Presenter = func(e Element, state interface{}) layout.Widget {
+		// Vary the element heights so that sizes recorded for one set of
+		// elements do not fit another.
+		n, _ := strconv.Atoi(string(e.Serial()))
+		return layout.Spacer{
+			Width:  unit.Dp(5),
+			Height: unit.Dp(float32(3 + n%4)),
+		}.Layout
+	}
+	m := NewManager(20, hooks)
+	m.Gravity = After
+	// Shut down the existing background processing for this manager.
+	close(m.requests)
+
+	// Replace the background processing channels with channels we can control
+	// from within the test.
+	updates := make(chan []stateUpdate, 1)
+	m.requests = nil
+	m.stateUpdates = updates
+
+	update := func(elements []Element) stateUpdate {
+		su := mkStateUpdate(dupSlice(elements), synth)
+		su.Type = pull
+		return su
+	}
+
+	updates <- []stateUpdate{update(testElements)}
+	list.Layout(gtx, m.UpdatedLen(&list), m.Layout)
+	// Scroll away from the end of the list.
+	list.Position.First, list.Position.Offset, list.Position.BeforeEnd = 2, 0, true
+	list.Layout(gtx, m.UpdatedLen(&list), m.Layout)
+
+	// Record the position of the last visible element.
+	last := list.Position.First + list.Position.Count - 1
+	serial := m.elements.Elements[last].Serial()
+	want, ok := m.startOf(&list, last)
+	if !ok {
+		t.Fatalf("expected element %d to be laid out", last)
+	}
+
+	// Remove the first elements, then prepend others, within one frame.
+	updates <- []stateUpdate{
+		update(testElements[3:]),
+		update(append([]Element{
+			testElement{serial: "100", synthCount: 1},
+			testElement{serial: "101", synthCount: 1},
+		}, testElements[3:]...)),
+	}
+	list.Layout(gtx, m.UpdatedLen(&list), m.Layout)
+
+	index, ok := m.elements.SerialToIndex[serial]
+	if !ok {
+		t.Fatalf("expected element %s to remain", serial)
+	}
+	got, ok := m.startOf(&list, index)
+	if !ok {
+		t.Fatalf("expected element %s to be laid out", serial)
+	}
+	if got != want {
+		t.Errorf("expected element %s to start at %d, got %d", serial, want, got)
+	}
+}
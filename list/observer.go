@@ -0,0 +1,67 @@
+package list
+
+import "time"
+
+// MetricKind identifies the kind of work described by a Metric.
+type MetricKind uint8
+
+const (
+	// LoadMetric reports an invocation of the Loader. Direction is the
+	// direction of the load, Duration its latency, and Count the number
+	// of elements loaded.
+	LoadMetric MetricKind = iota
+	// CompactMetric reports a compaction. Count is the number of elements
+	// discarded by it.
+	CompactMetric
+	// SynthesisMetric reports the synthesis of the elements. Duration is the
+	// time spent synthesizing, and Count the number of synthesized elements.
+	SynthesisMetric
+	// BatchMetric reports the delivery of a state update. Count is the
+	// number of state updates pending for the next frame, including the
+	// delivered one. Counts above one indicate that updates are produced
+	// faster than the list is laid out.
+	BatchMetric
+	// InvalidateMetric reports an invocation of the Invalidator.
+	InvalidateMetric
+)
+
+func (k MetricKind) String() string {
+	switch k {
+	case LoadMetric:
+		return "load"
+	case CompactMetric:
+		return "compact"
+	case SynthesisMetric:
+		return "synthesis"
+	case BatchMetric:
+		return "batch"
+	case InvalidateMetric:
+		return "invalidate"
+	default:
+		return "unknown"
+	}
+}
+
+// Metric describes some work performed by the processing goroutine of a
+// Manager. The meaning of each field depends upon the Kind.
+type Metric struct {
+	Kind      MetricKind
+	Direction Direction
+	Duration  time.Duration
+	Count     int
+}
+
+// Observer receives metrics from the processing goroutine of a Manager.
+// Observe is invoked from that goroutine, so it must be safe to use
+// concurrently with the layout goroutine, and should return quickly.
+type Observer interface {
+	Observe(Metric)
+}
+
+// ObserverFunc adapts a function into an Observer.
+type ObserverFunc func(Metric)
+
+// Observe invokes f.
+func (f ObserverFunc) Observe(m Metric) {
+	f(m)
+}
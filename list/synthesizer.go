@@ -21,6 +21,9 @@ type Synthesis struct {
 	ToSourceIndicies []int
 	// The source elements.
 	Source []Element
+	// Headers holds the indicies of the elements in Elements that are
+	// section headers, in ascending order.
+	Headers []int
 }
 
 func (s Synthesis) String() string {
@@ -91,6 +94,24 @@ func Synthesize(elements []Element, synth Synthesizer) Synthesis {
 		if e.Serial() != NoSerial {
 			s.SerialToIndex[e.Serial()] = i
 		}
+		if isHeader(e) {
+			s.Headers = append(s.Headers, i)
+		}
 	}
 	return s
 }
+
+// HeaderAt returns the index of the closest section header at or before the
+// element at index, and the index of the first section header after it.
+// Either may be -1 if there is no such header.
+func (s Synthesis) HeaderAt(index int) (current, next int) {
+	current, next = -1, -1
+	for _, h := range s.Headers {
+		if h > index {
+			next = h
+			break
+		}
+		current = h
+	}
+	return current, next
+}
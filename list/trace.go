@@ -0,0 +1,289 @@
+package list
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"gioui.org/layout"
+)
+
+// TraceKind identifies the kind of a TraceEvent.
+type TraceKind string
+
+const (
+	// TraceStart events begin a trace with a snapshot of the elements held
+	// by the Manager when recording started.
+	TraceStart TraceKind = "start"
+	// TraceModify events record the processing of a call to Modify (or one
+	// of its variants).
+	TraceModify TraceKind = "modify"
+	// TraceLoad events record the processing of a load request, including
+	// the results of the Loader.
+	TraceLoad TraceKind = "load"
+	// TracePosition events record a change of the position of the list
+	// displaying the Manager's elements.
+	TracePosition TraceKind = "position"
+)
+
+// TraceEvent is a single entry of a trace recorded by a Recorder. Most
+// fields are only meaningful for some kinds of event.
+type TraceEvent struct {
+	Kind TraceKind `json:"kind"`
+	// Update is the number of state updates produced by the Manager as of
+	// the event. For TracePosition events, it is instead the number of state
+	// updates that had been applied to the list when it was at Position.
+	Update int `json:"update"`
+	// MaxSize is the maximum size of the Manager (TraceStart).
+	MaxSize int `json:"maxSize,omitempty"`
+	// Elements holds the encoded elements held by the Manager (TraceStart),
+	// inserted or updated (TraceModify), or returned by the Loader
+	// (TraceLoad).
+	Elements [][]byte `json:"elements,omitempty"`
+	// UpdateOnly holds the encoded elements updated in place (TraceModify).
+	UpdateOnly [][]byte `json:"updateOnly,omitempty"`
+	// Remove holds the serials of the removed elements (TraceModify).
+	Remove []Serial `json:"remove,omitempty"`
+	// Direction and RelativeTo are the arguments passed to the Loader, and
+	// More its second result (TraceLoad).
+	Direction  Direction `json:"direction,omitempty"`
+	RelativeTo Serial    `json:"relativeTo,omitempty"`
+	More       bool      `json:"more,omitempty"`
+	// Ignore is the directions known to contain no more elements
+	// (TraceStart).
+	Ignore Direction `json:"ignore,omitempty"`
+	// Position is the position of the list (TracePosition).
+	Position *layout.Position `json:"position,omitempty"`
+	// Start and End are the serials of the elements at either end of the
+	// viewport.
+	Start Serial `json:"start,omitempty"`
+	End   Serial `json:"end,omitempty"`
+	// Synthesized is the sequence of synthesized element serials resulting
+	// from the event.
+	Synthesized []Serial `json:"synthesized,omitempty"`
+	// Compacted is the serials of the elements compacted or removed by the
+	// event.
+	Compacted []Serial `json:"compacted,omitempty"`
+}
+
+// ElementEncoder serializes an Element for a trace.
+type ElementEncoder func(Element) ([]byte, error)
+
+// ElementDecoder deserializes an Element encoded by an ElementEncoder.
+type ElementDecoder func([]byte) (Element, error)
+
+// Recorder writes a trace of the requests processed by a Manager (see
+// Manager.Record) to an io.Writer, as a stream of JSON-encoded TraceEvents.
+// The trace can be read back with ReadTrace and replayed with Replay.
+//
+// A nil *Recorder records nothing.
+type Recorder struct {
+	encoder ElementEncoder
+	mu      sync.Mutex
+	out     *json.Encoder
+	err     error
+}
+
+// NewRecorder returns a Recorder writing to w, using encoder to serialize
+// elements.
+func NewRecorder(w io.Writer, encoder ElementEncoder) *Recorder {
+	return &Recorder{
+		encoder: encoder,
+		out:     json.NewEncoder(w),
+	}
+}
+
+// Err returns the first error encountered while recording, if any. The
+// Recorder stops recording after an error.
+func (r *Recorder) Err() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// encode serializes elems, recording the first error encountered.
+func (r *Recorder) encode(elems []Element) [][]byte {
+	if r == nil || len(elems) == 0 {
+		return nil
+	}
+	encoded := make([][]byte, 0, len(elems))
+	for _, elem := range elems {
+		data, err := r.encoder(elem)
+		if err != nil {
+			r.fail(fmt.Errorf("encoding element %q: %w", elem.Serial(), err))
+			return nil
+		}
+		encoded = append(encoded, data)
+	}
+	return encoded
+}
+
+// add writes event to the trace.
+func (r *Recorder) add(event TraceEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err := r.out.Encode(event); err != nil {
+		r.err = fmt.Errorf("writing trace event: %w", err)
+	}
+}
+
+func (r *Recorder) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// ReadTrace reads the events written by a Recorder.
+func ReadTrace(r io.Reader) ([]TraceEvent, error) {
+	var trace []TraceEvent
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var event TraceEvent
+		if err := dec.Decode(&event); err != nil {
+			return nil, fmt.Errorf("reading trace event %d: %w", len(trace), err)
+		}
+		trace = append(trace, event)
+	}
+	return trace, nil
+}
+
+// Replay deterministically replays a trace recorded by a Recorder, returning
+// an error describing the first event whose outcome differs from the one
+// recorded. The Comparator and Synthesizer hooks are used to process the
+// trace, while the results of the Loader and the viewport are taken from
+// the trace itself. Replay checks that the same sequences of elements are
+// synthesized, that the same elements are compacted, and that the recorded
+// list positions map to the same viewports.
+func Replay(trace []TraceEvent, hooks Hooks, decoder ElementDecoder) error {
+	if len(trace) == 0 || trace[0].Kind != TraceStart {
+		return fmt.Errorf("trace does not begin with a %q event", TraceStart)
+	}
+	decode := func(encoded [][]byte) ([]Element, error) {
+		var elems []Element
+		for _, data := range encoded {
+			elem, err := decoder(data)
+			if err != nil {
+				return nil, fmt.Errorf("decoding element: %w", err)
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+	}
+
+	var (
+		load  TraceEvent
+		err   error
+		start = trace[0]
+		p     = newProcessor(start.MaxSize, hooks)
+	)
+	p.hooks.Loader = func(dir Direction, relativeTo Serial) ([]Element, bool) {
+		if dir != load.Direction || relativeTo != load.RelativeTo {
+			err = fmt.Errorf("loaded %v %q, recorded %v %q", dir, relativeTo, load.Direction, load.RelativeTo)
+		}
+		elems, decodeErr := decode(load.Elements)
+		if decodeErr != nil {
+			err = decodeErr
+		}
+		return elems, load.More
+	}
+	source, err := decode(start.Elements)
+	if err != nil {
+		return fmt.Errorf("event 0: %w", err)
+	}
+	p.compact.Apply(source, nil, nil)
+	p.synthesis = Synthesize(p.compact.elements, p.hooks.Synthesizer)
+	p.ignore = start.Ignore
+	p.viewport = viewport{Start: start.Start, End: start.End}
+	p.updates = start.Update
+	if got := serialsOf(p.synthesis.Elements); !sameSerials(got, start.Synthesized) {
+		return fmt.Errorf("event 0: synthesized %q, recorded %q", got, start.Synthesized)
+	}
+	// syntheses holds the synthesis produced by each state update, used to
+	// check list positions.
+	syntheses := map[int]Synthesis{p.updates: p.synthesis}
+
+	for i, event := range trace[1:] {
+		i++
+		var req interface{}
+		switch event.Kind {
+		case TracePosition:
+			synthesis, ok := syntheses[event.Update]
+			if !ok || event.Position == nil {
+				// The list was displaying elements from before the trace.
+				continue
+			}
+			start, end := synthesis.ViewportToSerials(*event.Position)
+			if start != event.Start || end != event.End {
+				return fmt.Errorf("event %d: position %+v is viewport [%q, %q], recorded [%q, %q]", i, *event.Position, start, end, event.Start, event.End)
+			}
+			continue
+		case TraceModify:
+			var modification modificationRequest
+			if modification.NewOrUpdate, err = decode(event.Elements); err != nil {
+				return fmt.Errorf("event %d: %w", i, err)
+			}
+			if modification.UpdateOnly, err = decode(event.UpdateOnly); err != nil {
+				return fmt.Errorf("event %d: %w", i, err)
+			}
+			modification.Remove = event.Remove
+			req = modification
+		case TraceLoad:
+			load = event
+			req = loadRequest{Direction: event.Direction, viewport: p.viewport}
+		default:
+			return fmt.Errorf("event %d: unexpected %q event", i, event.Kind)
+		}
+		su, ok := p.process(req, func() (viewport, bool) {
+			return viewport{Start: event.Start, End: event.End}, true
+		})
+		if err != nil {
+			return fmt.Errorf("event %d: %w", i, err)
+		}
+		if !ok || p.updates != event.Update {
+			return fmt.Errorf("event %d: produced update %d, recorded %d", i, p.updates, event.Update)
+		}
+		if got := serialsOf(su.Elements); !sameSerials(got, event.Synthesized) {
+			return fmt.Errorf("event %d: synthesized %q, recorded %q", i, got, event.Synthesized)
+		}
+		if !sameSerials(su.CompactedSerials, event.Compacted) {
+			return fmt.Errorf("event %d: compacted %q, recorded %q", i, su.CompactedSerials, event.Compacted)
+		}
+		syntheses[p.updates] = su.Synthesis
+	}
+	return nil
+}
+
+// serialsOf returns the serials of elems.
+func serialsOf(elems []Element) []Serial {
+	serials := make([]Serial, 0, len(elems))
+	for _, elem := range elems {
+		serials = append(serials, elem.Serial())
+	}
+	return serials
+}
+
+// sameSerials reports whether a and b hold the same serials in the same
+// order.
+func sameSerials(a, b []Serial) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
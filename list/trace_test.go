@@ -0,0 +1,122 @@
+package list
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gioui.org/io/system"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+)
+
+// TestRecordReplay ensures that a trace recorded from a Manager replays
+// identically, and that replaying it with different hooks is detected.
+func TestRecordReplay(t *testing.T) {
+	var source []Element
+	for i := 0; i < 40; i++ {
+		source = append(source, testElement{serial: fmt.Sprintf("%03d", i), synthCount: 1})
+	}
+	hooks := Hooks{
+		Synthesizer: testSynthesizer,
+		Comparator:  testComparator,
+		Loader: func(dir Direction, relativeTo Serial) ([]Element, bool) {
+			i := sort.Search(len(source), func(i int) bool {
+				return source[i].Serial() >= relativeTo
+			})
+			var start, end int
+			switch {
+			case relativeTo == NoSerial:
+				start, end = 0, min(5, len(source))
+			case dir == Before:
+				start, end = max(i-5, 0), i
+			default:
+				start, end = i+1, min(i+6, len(source))
+			}
+			if start >= end {
+				return nil, false
+			}
+			return append([]Element(nil), source[start:end]...), true
+		},
+		Presenter: func(Element, interface{}) layout.Widget {
+			return func(gtx layout.Context) layout.Dimensions {
+				return layout.Dimensions{Size: image.Pt(gtx.Constraints.Max.X, 10)}
+			}
+		},
+		Allocator:   func(Element) interface{} { return nil },
+		Invalidator: func() {},
+	}
+	m := NewManager(15, hooks)
+	defer m.Shutdown()
+	list := layout.List{Axis: layout.Vertical}
+	frame := func() {
+		var ops op.Ops
+		gtx := layout.NewContext(&ops, system.FrameEvent{
+			Now:    time.Now(),
+			Metric: unit.Metric{PxPerDp: 1, PxPerSp: 1},
+			Size:   image.Pt(100, 50),
+		})
+		list.Layout(gtx, m.UpdatedLen(&list), m.Layout)
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		frame()
+	}
+
+	// Record a session starting midway through.
+	var buf bytes.Buffer
+	recorder := NewRecorder(&buf, func(e Element) ([]byte, error) {
+		return []byte(e.Serial()), nil
+	})
+	m.Record(recorder)
+	for i := 0; i < 20; i++ {
+		list.Position.First++
+		frame()
+	}
+	m.Modify([]Element{testElement{serial: "020a", synthCount: 1}}, nil, []Serial{"021"})
+	for i := 0; i < 20; i++ {
+		list.Position.First--
+		frame()
+	}
+	m.Record(nil)
+	if err := recorder.Err(); err != nil {
+		t.Fatalf("recording: %v", err)
+	}
+
+	trace, err := ReadTrace(&buf)
+	if err != nil {
+		t.Fatalf("reading trace: %v", err)
+	}
+	kinds := map[TraceKind]int{}
+	for _, event := range trace {
+		kinds[event.Kind]++
+	}
+	for _, kind := range []TraceKind{TraceStart, TraceModify, TraceLoad, TracePosition} {
+		if kinds[kind] == 0 {
+			t.Errorf("expected the trace to contain %q events, got %v", kind, kinds)
+		}
+	}
+
+	decode := func(data []byte) (Element, error) {
+		return testElement{serial: string(data), synthCount: 1}, nil
+	}
+	if err := Replay(trace, hooks, decode); err != nil {
+		t.Errorf("replaying trace: %v", err)
+	}
+
+	// A change of synthesizer must cause the replay to diverge.
+	hooks.Synthesizer = func(previous, current, next Element) []Element {
+		if strings.HasSuffix(string(current.Serial()), "5") {
+			return nil
+		}
+		return testSynthesizer(previous, current, next)
+	}
+	if err := Replay(trace, hooks, decode); err == nil {
+		t.Errorf("expected replay with a different synthesizer to fail")
+	}
+}
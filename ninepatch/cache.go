@@ -0,0 +1,56 @@
+package ninepatch
+
+import (
+	"image"
+	"sync"
+
+	"gioui.org/op/paint"
+)
+
+// maxCachedPatches bounds the number of content sizes a cache holds patches
+// for. A single 9-Patch often backs many widgets, such as every message bubble
+// of a chat, each with content of its own size.
+const maxCachedPatches = 256
+
+// cache holds the state a NinePatch reuses from frame to frame. It is shared
+// by the copies of a NinePatch, and safe for concurrent use.
+type cache struct {
+	once sync.Once
+	op   paint.ImageOp
+
+	mu      sync.Mutex
+	layouts map[patchesKey]patches
+}
+
+// patchesKey identifies the patches laid out for content of Size, at a Scale
+// in pixels per pixel of the source image.
+type patchesKey struct {
+	Size  image.Point
+	Scale float32
+}
+
+// imageOp returns the paint.ImageOp for img, creating it on first use.
+func (c *cache) imageOp(img image.Image) paint.ImageOp {
+	c.once.Do(func() {
+		c.op = paint.NewImageOp(img)
+	})
+	return c.op
+}
+
+// patches returns the patches of the grid stretched to cover content of the
+// given size, computing them on first use. The cache is emptied once it holds
+// maxCachedPatches entries.
+func (c *cache) patches(g Grid, scale float32, size image.Point) patches {
+	key := patchesKey{Size: size, Scale: scale}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.layouts[key]; ok {
+		return p
+	}
+	if c.layouts == nil || len(c.layouts) >= maxCachedPatches {
+		c.layouts = make(map[patchesKey]patches)
+	}
+	p := stretch(g, scale, size)
+	c.layouts[key] = p
+	return p
+}
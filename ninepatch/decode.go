@@ -1,6 +1,7 @@
 package ninepatch
 
 import (
+	"fmt"
 	"image"
 	"image/color"
 
@@ -10,34 +11,39 @@ import (
 // DecodeNinePatch from source image.
 //
 // Note: Any colored pixel around the border will be considered a 9-Patch marker.
+// Use Decode to reject malformed images instead.
 func DecodeNinePatch(src image.Image) NinePatch {
 	var (
-		b      = src.Bounds()
-		inset  = PxInset{}
-		x1, x2 = 0, 0
-		y1, y2 = 0, 0
+		b                  = src.Bounds()
+		inset              = PxInset{}
+		x1, x2             = 0, 0
+		y1, y2             = 0, 0
+		xStretch, yStretch []Segment
 	)
-	right := walk(src, b.Max.X-1, layout.Vertical)
-	if right.IsValid() {
-		inset.Top = right.Start
-		inset.Bottom = b.Max.Y - right.End
+	if right := walk(src, b.Max.X-1, layout.Vertical); len(right) > 0 {
+		inset.Top = right[0].Start
+		inset.Bottom = b.Max.Y - right[0].End
 	}
-	bottom := walk(src, b.Max.Y-1, layout.Horizontal)
-	if bottom.IsValid() {
-		inset.Left = bottom.Start
-		inset.Right = b.Max.X - bottom.End
+	if bottom := walk(src, b.Max.Y-1, layout.Horizontal); len(bottom) > 0 {
+		inset.Left = bottom[0].Start
+		inset.Right = b.Max.X - bottom[0].End
 	}
-	top := walk(src, 0, layout.Vertical)
-	if top.IsValid() {
-		y1, y2 = top.Start, b.Max.Y-top.End
+	if top := walk(src, 0, layout.Vertical); len(top) > 0 {
+		y1, y2 = top[0].Start, b.Max.Y-top[len(top)-1].End
+		if len(top) > 1 {
+			yStretch = top
+		}
 	}
-	left := walk(src, 0, layout.Horizontal)
-	if left.IsValid() {
-		x1, x2 = left.Start, b.Max.X-left.End
+	if left := walk(src, 0, layout.Horizontal); len(left) > 0 {
+		x1, x2 = left[0].Start, b.Max.X-left[len(left)-1].End
+		if len(left) > 1 {
+			xStretch = left
+		}
 	}
 	return NinePatch{
 		Image:   eraseBorder(src),
 		Content: inset,
+		cache:   new(cache),
 		Grid: Grid{
 			Size: image.Point{
 				X: b.Dx(),
@@ -45,10 +51,117 @@ func DecodeNinePatch(src image.Image) NinePatch {
 			},
 			X1: x1, X2: x2,
 			Y1: y1, Y2: y2,
+			XStretch: xStretch,
+			YStretch: yStretch,
 		},
 	}
 }
 
+// FormatError reports a malformed 9-Patch image.
+type FormatError struct {
+	// Border is the border at fault: "top", "left", "bottom" or "right". It is
+	// empty if the problem is not specific to a border.
+	Border string
+	// Reason describes the problem.
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	if e.Border == "" {
+		return "ninepatch: " + e.Reason
+	}
+	return fmt.Sprintf("ninepatch: %s border: %s", e.Border, e.Reason)
+}
+
+// Decode a 9-Patch from the source image, like DecodeNinePatch, but report
+// malformed images with a *FormatError. A well formed 9-Patch image:
+//
+//   - is at least 3x3 pixels, leaving room for content within the border
+//   - has only opaque black or transparent pixels in its border
+//   - has transparent corners
+//   - marks at least one stretch region along its top and left borders
+//   - marks at most one content region along its bottom and right borders
+func Decode(src image.Image) (NinePatch, error) {
+	b := src.Bounds()
+	if b.Dx() < 3 || b.Dy() < 3 {
+		return NinePatch{}, &FormatError{
+			Reason: fmt.Sprintf("image is %dx%d pixels, want at least 3x3", b.Dx(), b.Dy()),
+		}
+	}
+	for _, pt := range []image.Point{
+		b.Min,
+		{X: b.Max.X - 1, Y: b.Min.Y},
+		{X: b.Min.X, Y: b.Max.Y - 1},
+		b.Max.Sub(image.Pt(1, 1)),
+	} {
+		if _, _, _, a := src.At(pt.X, pt.Y).RGBA(); a != 0 {
+			return NinePatch{}, &FormatError{
+				Reason: fmt.Sprintf("corner pixel (%d, %d) is not transparent", pt.X, pt.Y),
+			}
+		}
+	}
+	for _, border := range []struct {
+		Name    string
+		Start   image.Point
+		Step    image.Point
+		Length  int
+		Stretch bool
+	}{
+		{Name: "top", Start: image.Pt(b.Min.X+1, b.Min.Y), Step: image.Pt(1, 0), Length: b.Dx() - 2, Stretch: true},
+		{Name: "left", Start: image.Pt(b.Min.X, b.Min.Y+1), Step: image.Pt(0, 1), Length: b.Dy() - 2, Stretch: true},
+		{Name: "bottom", Start: image.Pt(b.Min.X+1, b.Max.Y-1), Step: image.Pt(1, 0), Length: b.Dx() - 2},
+		{Name: "right", Start: image.Pt(b.Max.X-1, b.Min.Y+1), Step: image.Pt(0, 1), Length: b.Dy() - 2},
+	} {
+		segments, err := markers(src, border.Start, border.Step, border.Length)
+		if err != nil {
+			err.Border = border.Name
+			return NinePatch{}, err
+		}
+		switch {
+		case border.Stretch && segments == 0:
+			return NinePatch{}, &FormatError{
+				Border: border.Name,
+				Reason: "missing stretch line",
+			}
+		case !border.Stretch && segments > 1:
+			return NinePatch{}, &FormatError{
+				Border: border.Name,
+				Reason: fmt.Sprintf("found %d content lines, want at most one", segments),
+			}
+		}
+	}
+	return DecodeNinePatch(src), nil
+}
+
+// markers walks n border pixels of src from start, in increments of step, and
+// counts the contiguous lines of markers found. It fails on any pixel that is
+// neither an opaque black marker nor transparent.
+func markers(src image.Image, start, step image.Point, n int) (int, *FormatError) {
+	var (
+		segments = 0
+		marked   = false
+	)
+	for ii, pt := 0, start; ii < n; ii, pt = ii+1, pt.Add(step) {
+		c := color.NRGBAModel.Convert(src.At(pt.X, pt.Y)).(color.NRGBA)
+		switch {
+		case c.A == 0:
+			marked = false
+		case c == color.NRGBA{A: 0xFF}:
+			if !marked {
+				segments++
+			}
+			marked = true
+		default:
+			return 0, &FormatError{
+				Reason: fmt.Sprintf(
+					"pixel (%d, %d) is #%02X%02X%02X%02X, want opaque black or transparent",
+					pt.X, pt.Y, c.R, c.G, c.B, c.A),
+			}
+		}
+	}
+	return segments, nil
+}
+
 // eraseBorder clears the 1px border around the image containing the 9-Patch
 // region specifiers (1px black lines).
 //
@@ -87,43 +200,32 @@ func eraseBorder(src image.Image) *image.NRGBA {
 	return out
 }
 
-// line encodes a one-dimensional line.
-type line struct {
-	Start, End int
-}
-
-func (l line) IsValid() bool {
-	return l.Start > -1 && l.End > -1
-}
-
 // walk pixels in the source image, along the specified main axis, and offset
-// along the cross axis, returning a line that describes the length of any
-// squence of colored pixels.
+// along the cross axis, returning the segments of contiguous colored pixels.
+// Each segment spans the half-open run [Start, End) of its colored pixels.
 //
 // NOTE(jfm): in time we may want tighter control over what is considered
 // "colored". For now, any color that is not zero will suffice.
-func walk(src image.Image, offset int, axis layout.Axis) line {
+func walk(src image.Image, offset int, axis layout.Axis) []Segment {
 	var (
-		end  = axis.Convert(src.Bounds().Max).X
-		line = line{Start: -1, End: -1}
+		end      = axis.Convert(src.Bounds().Max).X
+		segments []Segment
+		start    = -1
 	)
 	for ii := 0; ii < end; ii++ {
 		pt := axis.Convert(image.Point{X: ii, Y: offset})
 		r, g, b, a := src.At(pt.X, pt.Y).RGBA()
-		var (
-			colorIsSet = r > 0 || g > 0 || b > 0 || a > 0
-			startIsSet = line.Start > -1
-			endIsSet   = line.End > -1
-		)
-		if colorIsSet && !startIsSet {
-			line.Start = ii
-		}
-		if !colorIsSet && startIsSet {
-			line.End = ii
+		colorIsSet := r > 0 || g > 0 || b > 0 || a > 0
+		if colorIsSet && start < 0 {
+			start = ii
 		}
-		if startIsSet && endIsSet {
-			break
+		if !colorIsSet && start > -1 {
+			segments = append(segments, Segment{Start: start, End: ii})
+			start = -1
 		}
 	}
-	return line
+	if start > -1 {
+		segments = append(segments, Segment{Start: start, End: end})
+	}
+	return segments
 }
@@ -1,9 +1,17 @@
 package ninepatch
 
-import "image"
+import (
+	"image"
+
+	"gioui.org/layout"
+)
 
 // Grid describes the stretchable regions of a 9-Patch as 3x3 grid divided
 // by 4 lines.
+//
+// A 9-Patch may stretch along several segments of an axis, in which case the
+// grid is divided further: the runs of pixels between the segments stay
+// static.
 type Grid struct {
 	// Size specifies the total dimensions including static and stretch regions.
 	Size image.Point
@@ -13,13 +21,30 @@ type Grid struct {
 	// Y1 is the distance in pixels before the stretchable region along the Y axis.
 	// Y2 is the distance in pixels after the stretchable region along the Y axis.
 	Y1, Y2 int
+	// XStretch and YStretch list the stretchable segments along each axis, in
+	// ascending order, when there is more than one. The first segment starts
+	// at X1 (or Y1) and the last one ends X2 (or Y2) pixels before the end of
+	// the axis. If empty, the whole region between the lines stretches.
+	XStretch, YStretch []Segment
+}
+
+// Segment describes a run of pixels along one axis, from Start up to but not
+// including End.
+type Segment struct {
+	Start, End int
+}
+
+// Len returns the length of the segment in pixels.
+func (s Segment) Len() int {
+	return s.End - s.Start
 }
 
-// Static returns the statically known dimensions (the corners).
+// Static returns the statically known dimensions (the corners, and the runs
+// between stretchable segments).
 func (g Grid) Static() image.Point {
 	return image.Point{
-		X: g.X1 + g.X2,
-		Y: g.Y1 + g.Y2,
+		X: g.X1 + g.X2 + gaps(g.XStretch),
+		Y: g.Y1 + g.Y2 + gaps(g.YStretch),
 	}
 }
 
@@ -34,3 +59,47 @@ func (g Grid) Stretch() image.Point {
 	}
 	return stretch
 }
+
+// gaps returns the number of pixels between the segments.
+func gaps(segments []Segment) int {
+	var gaps int
+	for ii := 1; ii < len(segments); ii++ {
+		gaps += segments[ii].Start - segments[ii-1].End
+	}
+	return gaps
+}
+
+// band is a run of pixels along one axis of the grid, that either stretches
+// or stays static.
+type band struct {
+	Start, Len int
+	Stretch    bool
+}
+
+// bands divides the grid along the given axis into alternating static and
+// stretchable bands, omitting empty ones.
+func (g Grid) bands(axis layout.Axis) []band {
+	size, before, after, segments := g.Size.X, g.X1, g.X2, g.XStretch
+	if axis == layout.Vertical {
+		size, before, after, segments = g.Size.Y, g.Y1, g.Y2, g.YStretch
+	}
+	if len(segments) == 0 {
+		segments = []Segment{{Start: before, End: size - after}}
+	}
+	var (
+		bands []band
+		pos   int
+	)
+	add := func(start, end int, stretch bool) {
+		if end > start {
+			bands = append(bands, band{Start: start, Len: end - start, Stretch: stretch})
+		}
+	}
+	for _, s := range segments {
+		add(pos, s.Start, false)
+		add(s.Start, s.End, true)
+		pos = s.End
+	}
+	add(pos, size, false)
+	return bands
+}
@@ -5,7 +5,6 @@ package ninepatch
 import (
 	"image"
 	"math"
-	"sync"
 
 	"gioui.org/f32"
 	"gioui.org/layout"
@@ -22,9 +21,11 @@ type (
 
 // NinePatch can lay out a 9-Patch image as the background for another widget.
 //
-// Note: create a new instance per 9-Patch image. Changing the image.Image
-// after the first layout will have no effect because the paint.ImageOp is
-// cached.
+// A NinePatch obtained from Decode, DecodeNinePatch or LoadTheme caches its
+// paint.ImageOp, and the regions it lays out for each size of content, across
+// frames and copies of itself. Changing the image.Image or the Grid after the
+// first layout will have no effect. Other instances recompute everything each
+// frame.
 type NinePatch struct {
 	// Image is the backing image of the 9-Patch.
 	image.Image
@@ -33,9 +34,10 @@ type NinePatch struct {
 	// Inset describes content insets defined by the black lines on the bottom
 	// and right of the 9-Patch image.
 	Content PxInset
-	// Cache the image.
-	cache paint.ImageOp
-	once  sync.Once
+	// Scale of the image, in Dp per pixel. Defaults to DefaultScale.
+	Scale float32
+	// cache, if not nil, holds the state reused from frame to frame.
+	cache *cache
 }
 
 // PxInset describes an inset in pixels.
@@ -104,36 +106,26 @@ const DefaultScale = 1 / float32(160.0/72.0)
 
 // Layout the provided widget with the NinePatch as a background.
 func (n NinePatch) Layout(gtx C, w layout.Widget) D {
-	n.once.Do(func() {
-		n.cache = paint.NewImageOp(n.Image)
-	})
-
-	// TODO(jfm) [performance]: cache scaled grid instead of recomputing every
-	// frame.
-
-	// TODO(jfm): publicize scale factor in a way that is obvious to use and
-	// tested.
+	c := n.cache
+	if c == nil {
+		// Not decoded by this package: nothing persists beyond this frame.
+		c = new(cache)
+	}
 
-	scale := DefaultScale
+	scale := n.Scale
+	if scale <= 0 {
+		scale = DefaultScale
+	}
 
 	// Handle screen density.
 	scale *= gtx.Metric.PxPerDp
 
-	var (
-		src = n.Grid
-		str = Grid{
-			X1: int(math.Round(float64(src.X1) * float64(scale))),
-			X2: int(math.Round(float64(src.X2) * float64(scale))),
-			Y1: int(math.Round(float64(src.Y1) * float64(scale))),
-			Y2: int(math.Round(float64(src.Y2) * float64(scale))),
-		}
-		inset = layout.Inset{
-			Left:   unit.Dp(float32(n.Content.Left) * scale),
-			Right:  unit.Dp(float32(n.Content.Right) * scale),
-			Top:    unit.Dp(float32(n.Content.Top) * scale),
-			Bottom: unit.Dp(float32(n.Content.Bottom) * scale),
-		}
-	)
+	inset := layout.Inset{
+		Left:   unit.Dp(float32(n.Content.Left) * scale),
+		Right:  unit.Dp(float32(n.Content.Right) * scale),
+		Top:    unit.Dp(float32(n.Content.Top) * scale),
+		Bottom: unit.Dp(float32(n.Content.Bottom) * scale),
+	}
 
 	// Layout content in macro to compute it's dimensions.
 	// These dimensions are needed to figure out how much stretch is needed.
@@ -141,221 +133,104 @@ func (n NinePatch) Layout(gtx C, w layout.Widget) D {
 	dims := inset.Layout(gtx, w)
 	call := macro.Stop()
 
-	str.Size = dims.Size
-
-	// Handle tiny content: at least stretch by the amount that original does.
-	if str.Stretch().Y <= src.Stretch().Y {
-		dims.Size.Y = dims.Size.Y - str.Stretch().Y + src.Stretch().Y
-		str.Size.Y = str.Size.Y - str.Stretch().Y + src.Stretch().Y
-	}
-	if str.Stretch().X <= src.Stretch().X {
-		dims.Size.X = dims.Size.X - str.Stretch().X + src.Stretch().X
-		str.Size.X = str.Size.X - str.Stretch().X + src.Stretch().X
+	src := c.imageOp(n.Image)
+	patches := c.patches(n.Grid, scale, dims.Size)
+	for _, r := range patches.Regions {
+		r.Layout(gtx, src)
 	}
+	dims.Size = patches.Size
 
-	// Layout each of the 9 patches.
-
-	// upper left
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.X1,
-				Y: src.Y1,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.X1,
-				Y: str.Y1,
-			},
-		},
-	}.Layout(gtx, n.cache)
-
-	// upper middle
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.Stretch().X,
-				Y: src.Y1,
-			},
-			Offset: image.Point{
-				X: src.X1,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.Stretch().X,
-				Y: str.Y1,
-			},
-			Offset: image.Point{
-				X: str.X1,
-			},
-		},
-	}.Layout(gtx, n.cache)
-
-	// upper right
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.X2,
-				Y: src.Y1,
-			},
-			Offset: image.Point{
-				X: src.X1 + src.Stretch().X,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.X2,
-				Y: str.Y1,
-			},
-			Offset: image.Point{
-				X: str.X1 + str.Stretch().X,
-			},
-		},
-	}.Layout(gtx, n.cache)
-
-	// middle left
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.X1,
-				Y: src.Stretch().Y,
-			},
-			Offset: image.Point{
-				Y: src.Y1,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.X1,
-				Y: str.Stretch().Y,
-			},
-			Offset: image.Point{
-				Y: str.Y1,
-			},
-		},
-	}.Layout(gtx, n.cache)
-
-	// middle middle
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.Stretch().X,
-				Y: src.Stretch().Y,
-			},
-			Offset: image.Point{
-				X: src.X1,
-				Y: src.Y1,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.Stretch().X,
-				Y: str.Stretch().Y,
-			},
-			Offset: image.Point{
-				X: str.X1,
-				Y: str.Y1,
-			},
-		},
-	}.Layout(gtx, n.cache)
-
-	// middle right
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.X2,
-				Y: src.Stretch().Y,
-			},
-			Offset: image.Point{
-				X: src.X1 + src.Stretch().X,
-				Y: src.Y1,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.X2,
-				Y: str.Stretch().Y,
-			},
-			Offset: image.Point{
-				X: str.X1 + str.Stretch().X,
-				Y: str.Y1,
-			},
-		},
-	}.Layout(gtx, n.cache)
-
-	// lower left
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.X1,
-				Y: src.Y2,
-			},
-			Offset: image.Point{
-				Y: src.Y1 + src.Stretch().Y,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.X1,
-				Y: str.Y2,
-			},
-			Offset: image.Point{
-				Y: str.Y1 + str.Stretch().Y,
-			},
-		},
-	}.Layout(gtx, n.cache)
+	call.Add(gtx.Ops)
 
-	// lower middle
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.Stretch().X,
-				Y: src.Y2,
-			},
-			Offset: image.Point{
-				X: src.X1,
-				Y: src.Y1 + src.Stretch().Y,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.Stretch().X,
-				Y: str.Y2,
-			},
-			Offset: image.Point{
-				X: str.X1,
-				Y: str.Y1 + str.Stretch().Y,
-			},
-		},
-	}.Layout(gtx, n.cache)
+	return dims
+}
 
-	// lower right
-	Region{
-		Source: Patch{
-			Size: image.Point{
-				X: src.X2,
-				Y: src.Y2,
-			},
-			Offset: image.Point{
-				Y: src.Y1 + src.Stretch().Y,
-				X: src.X1 + src.Stretch().X,
-			},
-		},
-		Stretched: Patch{
-			Size: image.Point{
-				X: str.X2,
-				Y: str.Y2,
-			},
-			Offset: image.Point{
-				Y: str.Y1 + str.Stretch().Y,
-				X: str.X1 + str.Stretch().X,
-			},
-		},
-	}.Layout(gtx, n.cache)
+// patches describes the layout of a 9-Patch for a given size of content.
+type patches struct {
+	// Regions to lay out, row by row. Without extra stretch segments there
+	// are 9 of them.
+	Regions []Region
+	// Size covered by the regions.
+	Size image.Point
+}
 
-	call.Add(gtx.Ops)
+// stretch the grid, scaled by scale, to cover content of the given size.
+func stretch(g Grid, scale float32, size image.Point) patches {
+	var (
+		columns = g.bands(layout.Horizontal)
+		rows    = g.bands(layout.Vertical)
+		p       = patches{Regions: make([]Region, 0, len(columns)*len(rows))}
+	)
+	widths, width := scaleBands(columns, scale, size.X)
+	heights, height := scaleBands(rows, scale, size.Y)
+	p.Size = image.Point{X: width, Y: height}
+	var offset image.Point
+	for row, r := range rows {
+		offset.X = 0
+		for col, c := range columns {
+			p.Regions = append(p.Regions, Region{
+				Source: Patch{
+					Size: image.Point{
+						X: c.Len,
+						Y: r.Len,
+					},
+					Offset: image.Point{
+						X: c.Start,
+						Y: r.Start,
+					},
+				},
+				Stretched: Patch{
+					Size: image.Point{
+						X: widths[col],
+						Y: heights[row],
+					},
+					Offset: offset,
+				},
+			})
+			offset.X += widths[col]
+		}
+		offset.Y += heights[row]
+	}
+	return p
+}
 
-	return dims
+// scaleBands scales the bands along one axis to cover size pixels, returning
+// the scaled length of each band and the total length covered.
+//
+// Static bands are scaled as is, and the remaining space is shared among the
+// stretchable bands in proportion to their length in the source image.
+func scaleBands(bands []band, scale float32, size int) ([]int, int) {
+	var (
+		lengths   = make([]int, len(bands))
+		static    int
+		stretched int
+	)
+	for ii, b := range bands {
+		if b.Stretch {
+			stretched += b.Len
+			continue
+		}
+		lengths[ii] = int(math.Round(float64(b.Len) * float64(scale)))
+		static += lengths[ii]
+	}
+	space := size - static
+	if space < 0 {
+		space = 0
+	}
+	// Handle tiny content: at least stretch by the amount that original does.
+	if space <= stretched {
+		size = size - space + stretched
+		space = stretched
+	}
+	var seen, given int
+	for ii, b := range bands {
+		if !b.Stretch {
+			continue
+		}
+		seen += b.Len
+		next := space * seen / stretched
+		lengths[ii] = next - given
+		given = next
+	}
+	return lengths, size
 }
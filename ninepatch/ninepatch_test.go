@@ -1,13 +1,16 @@
 package ninepatch
 
 import (
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"reflect"
 	"testing"
 
 	"gioui.org/layout"
+	"gioui.org/op"
 	"gioui.org/unit"
 	"git.sr.ht/~gioverse/chat/res"
 )
@@ -87,14 +90,29 @@ func TestDecodeNinePatch(t *testing.T) {
 				},
 			},
 		},
+		{
+			Label: "image with multiple stretch regions",
+			Src: NewImg(image.Pt(100, 100)).
+				TopBorder(10, 20).
+				TopBorder(60, 30).
+				LeftBorder(25, 50),
+			NP: NP{
+				Grid: Grid{
+					Size: image.Point{X: 100, Y: 100},
+					X1:   10, X2: 10,
+					Y1: 25, Y2: 25,
+					XStretch: []Segment{{Start: 10, End: 30}, {Start: 60, End: 90}},
+				},
+			},
+		},
 		{
 			Label: "platocookie",
 			Src:   platocookie,
 			NP: NP{
 				Content: layout.Inset{
 					Top:    unit.Dp(31),
-					Right:  unit.Dp(70),
-					Bottom: unit.Dp(27),
+					Right:  unit.Dp(71),
+					Bottom: unit.Dp(28),
 					Left:   unit.Dp(70),
 				},
 				Grid: Grid{
@@ -102,8 +120,8 @@ func TestDecodeNinePatch(t *testing.T) {
 						X: platocookie.Bounds().Dx(),
 						Y: platocookie.Bounds().Dy(),
 					},
-					X1: 86, X2: 61,
-					Y1: 55, Y2: 47,
+					X1: 86, X2: 62,
+					Y1: 55, Y2: 48,
 				},
 			},
 		},
@@ -113,8 +131,8 @@ func TestDecodeNinePatch(t *testing.T) {
 			NP: NP{
 				Content: layout.Inset{
 					Top:    unit.Dp(31),
-					Right:  unit.Dp(70),
-					Bottom: unit.Dp(27),
+					Right:  unit.Dp(71),
+					Bottom: unit.Dp(28),
 					Left:   unit.Dp(70),
 				},
 				Grid: Grid{
@@ -122,8 +140,8 @@ func TestDecodeNinePatch(t *testing.T) {
 						X: hotdog.Bounds().Dx(),
 						Y: hotdog.Bounds().Dy(),
 					},
-					X1: 86, X2: 61,
-					Y1: 55, Y2: 47,
+					X1: 86, X2: 62,
+					Y1: 55, Y2: 48,
 				},
 			},
 		},
@@ -138,13 +156,294 @@ func TestDecodeNinePatch(t *testing.T) {
 				Grid: np.Grid,
 			}
 			want := tt.NP
-			if got != want {
+			if !reflect.DeepEqual(got, want) {
 				t.Fatalf("\n got:{%v} \nwant:{%v}\n", got, want)
 			}
 		})
 	}
 }
 
+// TestDecodeStretchRuns ensures that each stretch segment spans exactly the
+// run of marked pixels, including segments separated by a 1px gap and a
+// segment running to the edge of the image.
+func TestDecodeStretchRuns(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 12, 10))
+	mark := func(x, y int) {
+		img.Set(x, y, color.NRGBA{A: 255})
+	}
+	// Along the top border, runs [2,5) and [6,9) separated by the 1px gap
+	// at 5, and the single pixel run [10,11).
+	for _, x := range []int{2, 3, 4, 6, 7, 8, 10} {
+		mark(x, 0)
+	}
+	// Along the left border, the single pixel run [1,2) and the run [3,10)
+	// reaching the bottom edge.
+	for _, y := range []int{1, 3, 4, 5, 6, 7, 8, 9} {
+		mark(0, y)
+	}
+	grid := DecodeNinePatch(img).Grid
+	want := Grid{
+		Size: image.Pt(12, 10),
+		X1:   2, X2: 1,
+		Y1: 1, Y2: 0,
+		XStretch: []Segment{{Start: 2, End: 5}, {Start: 6, End: 9}, {Start: 10, End: 11}},
+		YStretch: []Segment{{Start: 1, End: 2}, {Start: 3, End: 10}},
+	}
+	if !reflect.DeepEqual(grid, want) {
+		t.Errorf("\n got: %+v\nwant: %+v", grid, want)
+	}
+}
+
+// TestDecode tests that malformed 9-Patch images are reported, naming the
+// border at fault.
+func TestDecode(t *testing.T) {
+	valid := func() *Img {
+		return NewImg(image.Pt(20, 20)).
+			TopBorder(8, 4).
+			LeftBorder(8, 4).
+			BottomBorder(2, 16).
+			RightBorder(2, 16)
+	}
+	for _, tt := range []struct {
+		Label  string
+		Src    image.Image
+		Border string
+		Err    bool
+	}{
+		{
+			Label: "valid",
+			Src:   valid(),
+		},
+		{
+			Label: "no content lines",
+			Src:   NewImg(image.Pt(20, 20)).TopBorder(8, 4).LeftBorder(8, 4),
+		},
+		{
+			Label: "platocookie",
+			Src:   platocookie,
+		},
+		{
+			Label: "hotdog",
+			Src:   hotdog,
+		},
+		{
+			Label: "too small",
+			Src:   NewImg(image.Pt(2, 20)),
+			Err:   true,
+		},
+		{
+			Label:  "missing top stretch line",
+			Src:    NewImg(image.Pt(20, 20)).LeftBorder(8, 4),
+			Border: "top",
+			Err:    true,
+		},
+		{
+			Label:  "missing left stretch line",
+			Src:    NewImg(image.Pt(20, 20)).TopBorder(8, 4),
+			Border: "left",
+			Err:    true,
+		},
+		{
+			Label: "multiple stretch lines",
+			Src:   valid().TopBorder(14, 3),
+		},
+		{
+			Label:  "multiple content lines",
+			Src:    NewImg(image.Pt(20, 20)).TopBorder(8, 4).LeftBorder(8, 4).RightBorder(2, 4).RightBorder(10, 4),
+			Border: "right",
+			Err:    true,
+		},
+		{
+			Label: "marked corner",
+			Src:   valid().TopBorder(0, 2),
+			Err:   true,
+		},
+		{
+			Label: "colored marker",
+			Src: func() image.Image {
+				img := valid()
+				img.Set(4, 19, color.NRGBA{R: 255, A: 255})
+				return img
+			}(),
+			Border: "bottom",
+			Err:    true,
+		},
+		{
+			Label: "translucent marker",
+			Src: func() image.Image {
+				img := valid()
+				img.Set(0, 9, color.NRGBA{A: 128})
+				return img
+			}(),
+			Border: "left",
+			Err:    true,
+		},
+	} {
+		t.Run(tt.Label, func(t *testing.T) {
+			np, err := Decode(tt.Src)
+			if !tt.Err {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if want := DecodeNinePatch(tt.Src); !reflect.DeepEqual(np.Grid, want.Grid) || np.Content != want.Content {
+					t.Fatalf("expected %+v, got %+v", want.Grid, np.Grid)
+				}
+				return
+			}
+			var fe *FormatError
+			if !errors.As(err, &fe) {
+				t.Fatalf("expected a *FormatError, got %v", err)
+			}
+			if fe.Border != tt.Border {
+				t.Fatalf("expected the %q border to be at fault, got %q: %v", tt.Border, fe.Border, err)
+			}
+		})
+	}
+}
+
+// TestScaleBands tests that grids are divided into bands, and that the bands
+// are scaled to cover the content, sharing the stretch among stretchable bands
+// in proportion to their source length.
+func TestScaleBands(t *testing.T) {
+	for _, tt := range []struct {
+		Label   string
+		Grid    Grid
+		Scale   float32
+		Size    int
+		Bands   []band
+		Lengths []int
+		Total   int
+	}{
+		{
+			Label: "single stretch region",
+			Grid:  Grid{Size: image.Pt(100, 100), X1: 20, X2: 30},
+			Scale: 0.5,
+			Size:  200,
+			Bands: []band{
+				{Start: 0, Len: 20},
+				{Start: 20, Len: 50, Stretch: true},
+				{Start: 70, Len: 30},
+			},
+			Lengths: []int{10, 175, 15},
+			Total:   200,
+		},
+		{
+			Label: "no stretch region",
+			Grid:  Grid{Size: image.Pt(100, 100)},
+			Scale: 1,
+			Size:  150,
+			Bands: []band{
+				{Start: 0, Len: 100, Stretch: true},
+			},
+			Lengths: []int{150},
+			Total:   150,
+		},
+		{
+			Label: "multiple stretch regions",
+			Grid: Grid{
+				Size: image.Pt(100, 100),
+				X1:   10, X2: 10,
+				XStretch: []Segment{{Start: 10, End: 30}, {Start: 50, End: 90}},
+			},
+			Scale: 1,
+			Size:  100 + 60,
+			Bands: []band{
+				{Start: 0, Len: 10},
+				{Start: 10, Len: 20, Stretch: true},
+				{Start: 30, Len: 20},
+				{Start: 50, Len: 40, Stretch: true},
+				{Start: 90, Len: 10},
+			},
+			Lengths: []int{10, 40, 20, 80, 10},
+			Total:   160,
+		},
+		{
+			Label: "tiny content",
+			Grid: Grid{
+				Size: image.Pt(100, 100),
+				X1:   10, X2: 10,
+				XStretch: []Segment{{Start: 10, End: 30}, {Start: 50, End: 90}},
+			},
+			Scale: 1,
+			Size:  10,
+			Bands: []band{
+				{Start: 0, Len: 10},
+				{Start: 10, Len: 20, Stretch: true},
+				{Start: 30, Len: 20},
+				{Start: 50, Len: 40, Stretch: true},
+				{Start: 90, Len: 10},
+			},
+			Lengths: []int{10, 20, 20, 40, 10},
+			Total:   70,
+		},
+	} {
+		t.Run(tt.Label, func(t *testing.T) {
+			bands := tt.Grid.bands(layout.Horizontal)
+			if !reflect.DeepEqual(bands, tt.Bands) {
+				t.Fatalf("expected bands %+v, got %+v", tt.Bands, bands)
+			}
+			lengths, total := scaleBands(bands, tt.Scale, tt.Size)
+			if !reflect.DeepEqual(lengths, tt.Lengths) || total != tt.Total {
+				t.Fatalf("expected lengths %v totalling %d, got %v totalling %d",
+					tt.Lengths, tt.Total, lengths, total)
+			}
+		})
+	}
+}
+
+// TestLayoutCache tests that a decoded NinePatch reuses its patches across
+// frames and copies, and lays out the same as one without a cache.
+func TestLayoutCache(t *testing.T) {
+	np := DecodeNinePatch(platocookie)
+	uncached := np
+	uncached.cache = nil
+	content := func(gtx C) D {
+		return D{Size: image.Pt(300, 120)}
+	}
+	for _, metric := range []unit.Metric{{PxPerDp: 1}, {PxPerDp: 2}} {
+		gtx := layout.Context{Ops: new(op.Ops), Metric: metric}
+		copied := np
+		if got, want := copied.Layout(gtx, content), uncached.Layout(gtx, content); got != want {
+			t.Errorf("expected dimensions %+v, got %+v", want, got)
+		}
+	}
+	if n := len(np.cache.layouts); n != 2 {
+		t.Errorf("expected patches cached for 2 metrics, got %d", n)
+	}
+}
+
+// benchmarkLayout lays out np around content of various sizes, as a list of
+// message bubbles would, reporting allocations per frame.
+func benchmarkLayout(b *testing.B, np NinePatch) {
+	var (
+		ops = new(op.Ops)
+		gtx = layout.Context{Ops: ops, Metric: unit.Metric{PxPerDp: 1}}
+	)
+	content := make([]layout.Widget, 10)
+	for ii := range content {
+		size := image.Pt(100+ii*20, 40+ii*10)
+		content[ii] = func(gtx C) D { return D{Size: size} }
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		ops.Reset()
+		for _, w := range content {
+			np.Layout(gtx, w)
+		}
+	}
+}
+
+func BenchmarkLayout(b *testing.B) {
+	benchmarkLayout(b, DecodeNinePatch(platocookie))
+}
+
+func BenchmarkLayoutUncached(b *testing.B) {
+	np := DecodeNinePatch(platocookie)
+	np.cache = nil
+	benchmarkLayout(b, np)
+}
+
 // NP wraps the layout data for a NinePatch for convenient equality testing.
 type NP struct {
 	Content layout.Inset
@@ -171,7 +470,7 @@ func NewImg(sz image.Point) *Img {
 
 // LeftBorder renders a line along the first column of pixels.
 func (img *Img) LeftBorder(start, size int) *Img {
-	for ii := start; ii < start+size-1; ii++ {
+	for ii := start; ii < start+size; ii++ {
 		img.Set(img.Bounds().Min.X, ii, color.NRGBA{A: 255})
 	}
 	return img
@@ -179,7 +478,7 @@ func (img *Img) LeftBorder(start, size int) *Img {
 
 // RightBorder renders a line along the last column of pixels.
 func (img *Img) RightBorder(start, size int) *Img {
-	for ii := start; ii < start+size-1; ii++ {
+	for ii := start; ii < start+size; ii++ {
 		img.Set(img.Bounds().Max.X-1, ii, color.NRGBA{A: 255})
 	}
 	return img
@@ -187,7 +486,7 @@ func (img *Img) RightBorder(start, size int) *Img {
 
 // TopBorder renders a line along the first row of pixels.
 func (img *Img) TopBorder(start, size int) *Img {
-	for ii := start; ii < start+size-1; ii++ {
+	for ii := start; ii < start+size; ii++ {
 		img.Set(ii, img.Bounds().Min.Y, color.NRGBA{A: 255})
 	}
 	return img
@@ -195,7 +494,7 @@ func (img *Img) TopBorder(start, size int) *Img {
 
 // BottomBorder renders a line along the last row of pixels.
 func (img *Img) BottomBorder(start, size int) *Img {
-	for ii := start; ii < start+size-1; ii++ {
+	for ii := start; ii < start+size; ii++ {
 		img.Set(ii, img.Bounds().Max.Y-1, color.NRGBA{A: 255})
 	}
 	return img
@@ -0,0 +1,181 @@
+package ninepatch
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ManifestName is the name of the manifest at the root of a theme pack.
+const ManifestName = "manifest.json"
+
+// Manifest describes a theme pack: a directory, or zip archive, holding a
+// manifest and the 9-Patch images it refers to. For example:
+//
+//	{
+//		"name": "hotdog",
+//		"scale": 0.45,
+//		"local": {
+//			"patch": "local.png",
+//			"text": "#000000"
+//		},
+//		"remote": {
+//			"patch": "remote.png",
+//			"text": "#FFFFFF",
+//			"inset": {"top": 31, "bottom": 27, "left": 70, "right": 70}
+//		}
+//	}
+type Manifest struct {
+	// Name of the theme.
+	Name string `json:"name"`
+	// Scale of the 9-Patch images. Defaults to DefaultScale.
+	Scale float32 `json:"scale,omitempty"`
+	// Local describes the bubble of the messages sent by the local user.
+	Local BubbleManifest `json:"local"`
+	// Remote describes the bubble of the messages sent by other users.
+	// Defaults to Local.
+	Remote *BubbleManifest `json:"remote,omitempty"`
+}
+
+// BubbleManifest describes a message bubble within a theme pack.
+type BubbleManifest struct {
+	// Patch is the path of the 9-Patch image within the theme pack.
+	Patch string `json:"patch"`
+	// Text is the color of text atop the bubble, as hexadecimal RGB or RGBA
+	// prefixed with '#'. If empty, the color is left to the caller.
+	Text string `json:"text,omitempty"`
+	// Inset, if set, overrides the content inset defined by the 9-Patch image.
+	Inset *PxInset `json:"inset,omitempty"`
+}
+
+// Theme is a set of message bubbles loaded from a theme pack.
+type Theme struct {
+	// Name of the theme.
+	Name string
+	// Local is the bubble of the messages sent by the local user, and Remote
+	// that of the messages sent by other users.
+	Local, Remote Bubble
+}
+
+// Bubble is a message bubble ready to lay out.
+type Bubble struct {
+	NinePatch
+	// TextColor is the color of text atop the bubble. It is transparent if the
+	// theme leaves the color to the caller.
+	TextColor color.NRGBA
+}
+
+// OpenTheme loads the theme pack at path, which is either a directory or a zip
+// archive.
+func OpenTheme(path string) (Theme, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Theme{}, fmt.Errorf("opening theme: %w", err)
+	}
+	if info.IsDir() {
+		return LoadTheme(os.DirFS(path))
+	}
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return Theme{}, fmt.Errorf("opening theme: %w", err)
+	}
+	defer zr.Close()
+	return LoadTheme(zr)
+}
+
+// LoadTheme loads the theme pack at the root of fsys, decoding the 9-Patch
+// images described by its manifest.
+func LoadTheme(fsys fs.FS) (Theme, error) {
+	return LoadThemeManifest(fsys, ManifestName)
+}
+
+// LoadThemeManifest loads the theme described by the manifest at the given
+// path within fsys, like LoadTheme. The paths of its 9-Patch images are relative to the
+// directory of the manifest, which allows several themes to share a
+// directory, each with a manifest of its own.
+func LoadThemeManifest(fsys fs.FS, manifest string) (Theme, error) {
+	data, err := fs.ReadFile(fsys, manifest)
+	if err != nil {
+		return Theme{}, fmt.Errorf("reading manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Theme{}, fmt.Errorf("decoding manifest: %w", err)
+	}
+	if m.Remote == nil {
+		m.Remote = &m.Local
+	}
+	dir := path.Dir(manifest)
+	m.Local.Patch = path.Join(dir, m.Local.Patch)
+	if m.Remote != &m.Local {
+		m.Remote.Patch = path.Join(dir, m.Remote.Patch)
+	}
+	local, err := loadBubble(fsys, m.Local, m.Scale)
+	if err != nil {
+		return Theme{}, fmt.Errorf("loading local bubble: %w", err)
+	}
+	remote, err := loadBubble(fsys, *m.Remote, m.Scale)
+	if err != nil {
+		return Theme{}, fmt.Errorf("loading remote bubble: %w", err)
+	}
+	return Theme{
+		Name:   m.Name,
+		Local:  local,
+		Remote: remote,
+	}, nil
+}
+
+// loadBubble decodes the bubble described by m from fsys.
+func loadBubble(fsys fs.FS, m BubbleManifest, scale float32) (Bubble, error) {
+	text, err := parseColor(m.Text)
+	if err != nil {
+		return Bubble{}, fmt.Errorf("parsing text color: %w", err)
+	}
+	f, err := fsys.Open(m.Patch)
+	if err != nil {
+		return Bubble{}, fmt.Errorf("opening patch: %w", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	if err != nil {
+		return Bubble{}, fmt.Errorf("decoding patch %q: %w", m.Patch, err)
+	}
+	np, err := Decode(img)
+	if err != nil {
+		return Bubble{}, fmt.Errorf("decoding patch %q: %w", m.Patch, err)
+	}
+	b := Bubble{
+		NinePatch: np,
+		TextColor: text,
+	}
+	b.NinePatch.Scale = scale
+	if m.Inset != nil {
+		b.NinePatch.Content = *m.Inset
+	}
+	return b, nil
+}
+
+// parseColor parses a color as hexadecimal RGB or RGBA prefixed with '#'. The
+// empty string is parsed as transparent.
+func parseColor(s string) (color.NRGBA, error) {
+	if s == "" {
+		return color.NRGBA{}, nil
+	}
+	ok := strings.HasPrefix(s, "#")
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 6 {
+		hex += "FF"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if !ok || len(hex) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
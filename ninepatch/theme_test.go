@@ -0,0 +1,229 @@
+package ninepatch
+
+import (
+	"archive/zip"
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+// encodePatch encodes a 9-Patch image with the given content inset.
+func encodePatch(t *testing.T, inset int) []byte {
+	img := NewImg(image.Pt(20, 20)).
+		LeftBorder(8, 4).
+		TopBorder(8, 4).
+		RightBorder(inset, 20-2*inset).
+		BottomBorder(inset, 20-2*inset)
+	return encodeImage(t, img)
+}
+
+// encodeImage encodes img as a png.
+func encodeImage(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encoding patch: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestLoadTheme ensures that theme packs are loaded according to their
+// manifest.
+func TestLoadTheme(t *testing.T) {
+	fsys := fstest.MapFS{
+		ManifestName: {Data: []byte(`{
+			"name": "test",
+			"scale": 0.5,
+			"local": {"patch": "local.png", "text": "#102030"},
+			"remote": {
+				"patch": "patches/remote.png",
+				"text": "#10203040",
+				"inset": {"top": 1, "bottom": 2, "left": 3, "right": 4}
+			}
+		}`)},
+		"local.png":          {Data: encodePatch(t, 2)},
+		"patches/remote.png": {Data: encodePatch(t, 5)},
+	}
+	theme, err := LoadTheme(fsys)
+	if err != nil {
+		t.Fatalf("loading theme: %v", err)
+	}
+	if theme.Name != "test" {
+		t.Errorf("expected the theme to be named %q, got %q", "test", theme.Name)
+	}
+	for _, tc := range []struct {
+		name   string
+		bubble *Bubble
+		text   color.NRGBA
+		inset  PxInset
+	}{
+		{
+			name:   "local",
+			bubble: &theme.Local,
+			text:   color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xFF},
+			inset:  PxInset{Top: 2, Bottom: 2, Left: 2, Right: 2},
+		},
+		{
+			name:   "remote",
+			bubble: &theme.Remote,
+			text:   color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0x40},
+			inset:  PxInset{Top: 1, Bottom: 2, Left: 3, Right: 4},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.bubble.TextColor != tc.text {
+				t.Errorf("expected text color %v, got %v", tc.text, tc.bubble.TextColor)
+			}
+			if tc.bubble.Content != tc.inset {
+				t.Errorf("expected inset %+v, got %+v", tc.inset, tc.bubble.Content)
+			}
+			if tc.bubble.Scale != 0.5 {
+				t.Errorf("expected scale 0.5, got %v", tc.bubble.Scale)
+			}
+			if want := (Grid{Size: image.Pt(20, 20), X1: 8, X2: 8, Y1: 8, Y2: 8}); !reflect.DeepEqual(tc.bubble.Grid, want) {
+				t.Errorf("expected grid %+v, got %+v", want, tc.bubble.Grid)
+			}
+		})
+	}
+}
+
+// TestLoadThemeManifest ensures that themes sharing a directory are loaded
+// from their own manifest, relative to which their patches are found.
+func TestLoadThemeManifest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"themes/a.json":       {Data: []byte(`{"name": "a", "local": {"patch": "a.png"}, "remote": {"patch": "shared/b.png"}}`)},
+		"themes/b.json":       {Data: []byte(`{"name": "b", "local": {"patch": "shared/b.png"}}`)},
+		"themes/a.png":        {Data: encodePatch(t, 2)},
+		"shared/b.png":        {Data: encodePatch(t, 5)},
+		"themes/shared/b.png": {Data: encodePatch(t, 5)},
+	}
+	for _, tc := range []struct {
+		manifest      string
+		local, remote PxInset
+	}{
+		{
+			manifest: "themes/a.json",
+			local:    PxInset{Top: 2, Bottom: 2, Left: 2, Right: 2},
+			remote:   PxInset{Top: 5, Bottom: 5, Left: 5, Right: 5},
+		},
+		{
+			manifest: "themes/b.json",
+			local:    PxInset{Top: 5, Bottom: 5, Left: 5, Right: 5},
+			remote:   PxInset{Top: 5, Bottom: 5, Left: 5, Right: 5},
+		},
+	} {
+		theme, err := LoadThemeManifest(fsys, tc.manifest)
+		if err != nil {
+			t.Errorf("loading %s: %v", tc.manifest, err)
+			continue
+		}
+		if theme.Local.Content != tc.local || theme.Remote.Content != tc.remote {
+			t.Errorf("loading %s: expected insets %+v and %+v, got %+v and %+v",
+				tc.manifest, tc.local, tc.remote, theme.Local.Content, theme.Remote.Content)
+		}
+	}
+	delete(fsys, "themes/shared/b.png")
+	if _, err := LoadThemeManifest(fsys, "themes/b.json"); err == nil {
+		t.Errorf("expected patches to be found relative to the manifest")
+	}
+}
+
+// TestLoadThemeErrors ensures that malformed theme packs are reported.
+func TestLoadThemeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{
+			name: "missing manifest",
+			fsys: fstest.MapFS{"local.png": {Data: encodePatch(t, 2)}},
+		},
+		{
+			name: "malformed manifest",
+			fsys: fstest.MapFS{ManifestName: {Data: []byte(`{"local":`)}},
+		},
+		{
+			name: "missing patch",
+			fsys: fstest.MapFS{ManifestName: {Data: []byte(`{"local": {"patch": "local.png"}}`)}},
+		},
+		{
+			name: "malformed patch",
+			fsys: fstest.MapFS{
+				ManifestName: {Data: []byte(`{"local": {"patch": "local.png"}}`)},
+				"local.png":  {Data: []byte("not a png")},
+			},
+		},
+		{
+			name: "malformed 9-Patch",
+			fsys: fstest.MapFS{
+				ManifestName: {Data: []byte(`{"local": {"patch": "local.png"}}`)},
+				"local.png":  {Data: encodeImage(t, NewImg(image.Pt(20, 20)))},
+			},
+		},
+		{
+			name: "malformed color",
+			fsys: fstest.MapFS{
+				ManifestName: {Data: []byte(`{"local": {"patch": "local.png", "text": "102030"}}`)},
+				"local.png":  {Data: encodePatch(t, 2)},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := LoadTheme(tc.fsys); err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+// TestOpenTheme ensures that theme packs are opened from both directories and
+// zip archives, and that the remote bubble defaults to the local one.
+func TestOpenTheme(t *testing.T) {
+	files := map[string][]byte{
+		ManifestName: []byte(`{"name": "test", "local": {"patch": "bubble.png"}}`),
+		"bubble.png": encodePatch(t, 2),
+	}
+	dir := t.TempDir()
+	pack := filepath.Join(dir, "pack")
+	if err := os.Mkdir(pack, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(pack, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pack.zip"), archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{pack, filepath.Join(dir, "pack.zip")} {
+		theme, err := OpenTheme(path)
+		if err != nil {
+			t.Errorf("opening %s: %v", path, err)
+			continue
+		}
+		if theme.Name != "test" || !reflect.DeepEqual(theme.Remote.Grid, theme.Local.Grid) || theme.Remote.TextColor.A != 0 {
+			t.Errorf("opening %s: expected the remote bubble to match the local one, got %+v", path, theme)
+		}
+	}
+	if _, err := OpenTheme(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error opening a missing theme")
+	}
+}
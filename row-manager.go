@@ -1,6 +1,15 @@
 package chat
 
-import "gioui.org/layout"
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sync/atomic"
+
+	"gioui.org/layout"
+	"git.sr.ht/~gioverse/chat/list"
+)
 
 // RowID uniquely identifies a row of content.
 type RowID string
@@ -31,43 +40,357 @@ type Allocator func(current Row) (state interface{})
 // RowManager presents heterogenous Row data. Each row could represent
 // any element of an interface that occupies a horizontal slice of
 // screen real-estate.
+//
+// RowManager is a compatibility adapter over list.Manager. The Rows are
+// loaded into a list.Manager from memory, and the list.Manager allocates
+// state for them and presents them. The state of any row removed from Rows
+// is discarded. New code should use list.Manager directly.
+//
+// Rows should have unique IDs. A row repeating the ID of an earlier row is
+// allocated state of its own, which is discarded whenever the row moves
+// within Rows.
 type RowManager struct {
-	// Rows is the list of data to present.
+	// Rows is the list of data to present. Changes to Rows are picked up
+	// by Len and UpdatedLen.
 	Rows []Row
-	// presenter is a function that can transform a single Row into
-	// a presentable widget.
-	presenter Presenter
-	// allocator is a function that can instantiate the state for a particular
-	// Row.
-	allocator Allocator
-	// rowState is a map storing the state for the Rows managed
-	// by the manager.
-	rowState map[RowID]interface{}
+	// manager does the actual work of managing and presenting the rows.
+	// It is started by the first layout.
+	manager *list.Manager
+	// maxSize and hooks configure the manager.
+	maxSize int
+	hooks   list.Hooks
+	// store serves the rows to the manager.
+	store *rowStore
+	// list stands in for the application's layout.List when using Len.
+	list layout.List
+	// length is the number of rows reported by Len.
+	length int
 }
 
+// unbounded is a list.Manager size large enough to never compact any rows.
+// list.Compact adds multiples of its size to element indices, so it is kept
+// well below math.MaxInt32 to leave room for that arithmetic on 32-bit
+// platforms.
+const unbounded = math.MaxInt32 / 4
+
 // NewManager constructs a manager with the given allocator and presenter.
+//
+// The manager holds every row in memory, exactly like its Rows field. To
+// compact the rows far away from the viewport, use NewRowManager.
+//
+// The manager starts processing the rows in the background when it is first
+// laid out. From then on, Shutdown must be called to stop that processing
+// once the manager is no longer needed.
 func NewManager(allocator Allocator, presenter Presenter) *RowManager {
-	return &RowManager{
-		presenter: presenter,
-		allocator: allocator,
-		rowState:  make(map[RowID]interface{}),
+	return newRowManager(unbounded, unbounded, func() {}, allocator, presenter)
+}
+
+// NewRowManager constructs a manager with the given allocator and presenter
+// that keeps at most maxSize rows (and their state) in memory at once,
+// discarding the rows furthest away from the viewport. invalidator must
+// trigger a new frame in the window displaying the rows (usually
+// app.Window.Invalidate).
+//
+// Compaction requires the manager to adjust the scroll position of the
+// list displaying the rows, so the manager must be laid out using
+// UpdatedLen rather than Len. As with NewManager, Shutdown must be called
+// once a manager that has been laid out is no longer needed.
+func NewRowManager(maxSize int, invalidator func(), allocator Allocator, presenter Presenter) *RowManager {
+	return newRowManager(maxSize, max(maxSize/2, 1), invalidator, allocator, presenter)
+}
+
+func newRowManager(maxSize, pageSize int, invalidator func(), allocator Allocator, presenter Presenter) *RowManager {
+	store := &rowStore{pageSize: pageSize}
+	store.snapshot.Store(newRowSnapshot(nil))
+	m := &RowManager{store: store, maxSize: maxSize}
+	m.hooks = list.Hooks{
+		Synthesizer: func(previous, current, next list.Element) []list.Element {
+			if current.(rowElement).Row == nil {
+				// Hide the boundaries of the rows.
+				return nil
+			}
+			return []list.Element{current}
+		},
+		Comparator: func(a, b list.Element) bool {
+			rows := store.current()
+			return rows.position(a) < rows.position(b)
+		},
+		Loader: store.load,
+		Presenter: func(current list.Element, state interface{}) layout.Widget {
+			return presenter(current.(rowElement).Row, state)
+		},
+		Allocator: func(current list.Element) interface{} {
+			row := current.(rowElement).Row
+			if row.ID() == NoID {
+				return nil
+			}
+			return allocator(row)
+		},
+		Invalidator: func() {
+			atomic.StoreInt32(&store.updated, 1)
+			invalidator()
+		},
+	}
+	return m
+}
+
+// managed returns the list.Manager of the rows, starting it on first use.
+func (m *RowManager) managed() *list.Manager {
+	if m.manager == nil {
+		m.manager = list.NewManager(m.maxSize, m.hooks)
 	}
+	return m.manager
 }
 
 // Layout the Row at position index within the manager's Row list.
 func (m *RowManager) Layout(gtx layout.Context, index int) layout.Dimensions {
-	data := m.Rows[index]
-	id := data.ID()
-	state, ok := m.rowState[id]
-	if !ok && id != NoID {
-		state = m.allocator(data)
-		m.rowState[id] = state
-	}
-	widget := m.presenter(data, state)
-	return widget(gtx)
+	return m.managed().Layout(gtx, index)
 }
 
 // Len returns the number of rows managed by this manager.
+//
+// Len cannot adjust the position of the list displaying the rows, so it
+// should only be used with managers constructed by NewManager.
 func (m *RowManager) Len() int {
-	return len(m.Rows)
+	m.sync()
+	// Without a list to adjust, there is nothing to do unless the manager
+	// produced new state. While it is empty, it may yet need to request the
+	// first rows.
+	if atomic.SwapInt32(&m.store.updated, 0) == 1 || m.length == 0 {
+		m.length = m.managed().UpdatedLen(&m.list)
+	}
+	return m.length
+}
+
+// UpdatedLen returns the number of rows managed by this manager, and
+// updates the state of the manager and the provided list prior to layout.
+// See list.Manager.UpdatedLen.
+//
+// Changes to Rows are processed synchronously, so this method may
+// briefly block if Rows has changed since the previous frame.
+func (m *RowManager) UpdatedLen(list *layout.List) int {
+	m.sync()
+	return m.managed().UpdatedLen(list)
+}
+
+// Shutdown stops the background processing of the manager, and waits for it
+// to exit. After this, the manager can no longer be used.
+func (m *RowManager) Shutdown() {
+	_ = m.ShutdownContext(context.Background())
+}
+
+// ShutdownContext is like Shutdown, but gives up waiting once ctx is done
+// (see list.Manager.ShutdownContext).
+func (m *RowManager) ShutdownContext(ctx context.Context) error {
+	if m.manager == nil {
+		// The manager was never laid out, so there is nothing to stop.
+		return nil
+	}
+	return m.manager.ShutdownContext(ctx)
+}
+
+// sync pushes the changes to Rows since the previous frame, if any, into the
+// manager.
+//
+// Checking for changes costs a comparison per row each frame, and
+// reflection only for rows of types that are not comparable.
+func (m *RowManager) sync() {
+	rows := m.store.current().rows
+	changed := len(m.Rows) != len(rows)-2
+	for i := 0; i < len(m.Rows) && !changed; i++ {
+		changed = !rows[i+1].holds(m.Rows[i])
+	}
+	if changed {
+		m.store.push(m.managed(), m.Rows)
+	}
+}
+
+// rowElement adapts a Row into a list.Element.
+type rowElement struct {
+	Row
+	// serial is the ID of the row, or a placeholder derived from index for
+	// rows without one (or with the ID of an earlier row). Compaction
+	// requires every element to have a unique serial.
+	serial list.Serial
+	// index of the row within Rows when the element was created.
+	index int
+	// comparable reports whether Row can be compared with ==.
+	comparable bool
+}
+
+func newRowElement(row Row, serial list.Serial, index int) rowElement {
+	return rowElement{
+		Row:        row,
+		serial:     serial,
+		index:      index,
+		comparable: row == nil || reflect.TypeOf(row).Comparable(),
+	}
+}
+
+func (r rowElement) Serial() list.Serial {
+	return r.serial
+}
+
+// holds reports whether the element holds row. Rows of types that are not
+// comparable are considered the same if their IDs match.
+func (r rowElement) holds(row Row) bool {
+	if r.comparable {
+		// Interfaces holding different types are unequal, so this cannot
+		// panic on a row of some type that is not comparable.
+		return row == r.Row
+	}
+	return reflect.TypeOf(row) == reflect.TypeOf(r.Row) && row.ID() == r.ID()
+}
+
+// Serials of the invisible elements bounding the rows (see rowStore). They,
+// and the placeholder serials of rows without a unique ID, start with a NUL
+// byte to keep them apart from any sensible RowID.
+const (
+	// startSerial is the serial of the element sorting before all rows.
+	startSerial = list.Serial("\x00start")
+	// endSerial is the serial of the element sorting after all rows.
+	endSerial = list.Serial("\x00end")
+)
+
+// rowStore serves the rows of a RowManager to its list.Manager.
+//
+// The rows are bounded by two invisible elements sorting before and after
+// all of them. The list.Manager ignores modifications that sort outside of
+// the elements it has loaded, which would otherwise prevent rows added to
+// either end of Rows from being inserted until they were loaded.
+type rowStore struct {
+	// snapshot holds the current *rowSnapshot. Snapshots are never
+	// modified, so the hooks of the list.Manager can read them from its
+	// processing goroutine without locking.
+	snapshot atomic.Value
+	// updated is set to 1 whenever the manager produces new state.
+	updated int32
+	// pageSize is the maximum number of elements returned by each load.
+	pageSize int
+}
+
+// rowSnapshot is a version of the rows of a rowStore.
+type rowSnapshot struct {
+	// rows of the snapshot, including the boundaries.
+	rows []rowElement
+	// index maps the serial of each element to its index within Rows.
+	index map[list.Serial]int
+}
+
+func newRowSnapshot(rows []Row) *rowSnapshot {
+	s := &rowSnapshot{
+		rows:  make([]rowElement, 0, len(rows)+2),
+		index: make(map[list.Serial]int, len(rows)+2),
+	}
+	add := func(e rowElement) {
+		s.rows = append(s.rows, e)
+		s.index[e.serial] = e.index
+	}
+	add(newRowElement(nil, startSerial, -1))
+	for i, row := range rows {
+		serial := list.Serial(row.ID())
+		if _, dup := s.index[serial]; serial == list.NoSerial || dup {
+			serial = list.Serial(fmt.Sprintf("\x00%d", i))
+		}
+		add(newRowElement(row, serial, i))
+	}
+	add(newRowElement(nil, endSerial, len(rows)))
+	return s
+}
+
+// position returns the index of the element within the rows, falling back
+// to its index when it was created for rows that were since removed.
+func (s *rowSnapshot) position(e list.Element) int {
+	if i, ok := s.index[e.Serial()]; ok {
+		return i
+	}
+	return e.(rowElement).index
+}
+
+// current returns the current snapshot of the rows.
+func (s *rowStore) current() *rowSnapshot {
+	return s.snapshot.Load().(*rowSnapshot)
+}
+
+// push replaces the rows of the store and pushes the changes into the
+// manager, blocking until the manager has processed them.
+//
+// Only the boundaries, the new rows, the rows that changed or moved relative
+// to the others, and the serials of removed rows are pushed. The manager sorts
+// its elements after each modification, so the rows that kept their relative
+// order fall into place on their own. The boundaries are pushed in case the
+// manager never loaded them, and it ignores them unless it holds the
+// corresponding end of the rows.
+func (s *rowStore) push(m *list.Manager, rows []Row) {
+	var (
+		prev    = s.current()
+		next    = newRowSnapshot(rows)
+		changed = []list.Element{next.rows[0], next.rows[len(next.rows)-1]}
+		removed []list.Serial
+		// last is the greatest previous index of the rows kept so far.
+		last = -1
+	)
+	s.snapshot.Store(next)
+	for _, e := range next.rows[1 : len(next.rows)-1] {
+		i, ok := prev.index[e.serial]
+		if !ok || i < last || !prev.rows[i+1].holds(e.Row) {
+			changed = append(changed, e)
+			continue
+		}
+		last = i
+	}
+	for serial := range prev.index {
+		if _, ok := next.index[serial]; !ok {
+			removed = append(removed, serial)
+		}
+	}
+	m.Modify(changed, nil, removed)
+	// The manager processes requests in order, and ignores empty ones, so
+	// it will not accept this one until the changes above are ready for
+	// layout.
+	m.Modify(nil, nil, nil)
+}
+
+// load implements list.Loader, returning a page of rows on the requested
+// side of relativeTo.
+func (s *rowStore) load(dir list.Direction, relativeTo list.Serial) ([]list.Element, bool) {
+	rows := s.current()
+	var start, end int
+	if relativeTo == list.NoSerial {
+		start, end = 0, min(s.pageSize, len(rows.rows))
+	} else {
+		i, ok := rows.index[relativeTo]
+		if !ok {
+			return nil, false
+		}
+		// Convert the index within Rows to an index within the rows of
+		// the snapshot.
+		i++
+		switch dir {
+		case list.Before:
+			start, end = max(i-s.pageSize, 0), i
+		case list.After:
+			start, end = i+1, i+1+min(s.pageSize, len(rows.rows)-i-1)
+		}
+	}
+	page := make([]list.Element, 0, end-start)
+	for _, row := range rows.rows[start:end] {
+		page = append(page, row)
+	}
+	more := (dir == list.Before && start > 0) || (dir == list.After && end < len(rows.rows))
+	return page, more
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
 }
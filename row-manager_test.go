@@ -0,0 +1,386 @@
+package chat
+
+import (
+	"bytes"
+	"image"
+	"testing"
+	"time"
+
+	"gioui.org/io/system"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/unit"
+	"git.sr.ht/~gioverse/chat/list"
+)
+
+// testRow is a row for testing. Rows with an empty id are stateless.
+type testRow struct {
+	id   string
+	text string
+}
+
+func (r testRow) ID() RowID {
+	return RowID(r.id)
+}
+
+// testRowState is the state allocated for each stateful testRow.
+type testRowState struct {
+	id string
+}
+
+// rowHarness lays out a RowManager and records what it presented.
+type rowHarness struct {
+	m     *RowManager
+	list  layout.List
+	size  image.Point
+	alloc []string
+	// presented holds the rows presented during the last frame.
+	presented []testRow
+	// states holds the state presented with each row during the last frame.
+	states map[string]*testRowState
+}
+
+func newRowHarness(size image.Point, construct func(Allocator, Presenter) *RowManager) *rowHarness {
+	h := &rowHarness{size: size, list: layout.List{Axis: layout.Vertical}}
+	h.m = construct(
+		func(current Row) interface{} {
+			r := current.(testRow)
+			h.alloc = append(h.alloc, r.id)
+			return &testRowState{id: r.id}
+		},
+		func(current Row, state interface{}) layout.Widget {
+			r := current.(testRow)
+			h.presented = append(h.presented, r)
+			if s, ok := state.(*testRowState); ok {
+				h.states[r.id] = s
+			}
+			return func(gtx layout.Context) layout.Dimensions {
+				return layout.Dimensions{Size: image.Pt(gtx.Constraints.Max.X, 10)}
+			}
+		},
+	)
+	return h
+}
+
+// frame lays out the manager once. If legacy is set, the manager is laid out
+// using Len rather than UpdatedLen.
+func (h *rowHarness) frame(legacy bool) {
+	var ops op.Ops
+	gtx := layout.NewContext(&ops, system.FrameEvent{
+		Now:    time.Now(),
+		Metric: unit.Metric{PxPerDp: 1, PxPerSp: 1},
+		Size:   h.size,
+	})
+	h.presented = h.presented[:0]
+	h.states = make(map[string]*testRowState)
+	length := 0
+	if legacy {
+		length = h.m.Len()
+	} else {
+		length = h.m.UpdatedLen(&h.list)
+	}
+	h.list.Layout(gtx, length, h.m.Layout)
+}
+
+func rowIDs(rows []testRow) []string {
+	ids := make([]string, 0, len(rows))
+	for _, r := range rows {
+		ids = append(ids, r.id)
+	}
+	return ids
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestRowManagerLazy ensures that a RowManager does not start processing
+// rows in the background until it is laid out.
+func TestRowManagerLazy(t *testing.T) {
+	h := newRowHarness(image.Pt(100, 1000), NewManager)
+	if h.m.manager != nil {
+		t.Fatalf("expected the manager not to start before layout")
+	}
+	// Shutting down a manager that never started has nothing to wait for.
+	h.m.Shutdown()
+
+	h = newRowHarness(image.Pt(100, 1000), NewManager)
+	defer h.m.Shutdown()
+	h.m.Rows = []Row{testRow{id: "a"}}
+	h.frame(true)
+	if h.m.manager == nil {
+		t.Fatalf("expected the manager to start on layout")
+	}
+}
+
+// TestRowManagerMigration ensures that a RowManager constructed the legacy
+// way behaves as it always has: every row in Rows is presented in order
+// during the same frame, and state is allocated once per stateful row.
+func TestRowManagerMigration(t *testing.T) {
+	h := newRowHarness(image.Pt(100, 1000), NewManager)
+	defer h.m.Shutdown()
+
+	type testcase struct {
+		name string
+		// rows to display during the frame.
+		rows []Row
+		// presented is the ids of the rows expected to be presented.
+		presented []string
+		// alloc is the ids of the rows expected to allocate state.
+		alloc []string
+		// text is the expected text of rows by id.
+		text map[string]string
+	}
+	for _, tc := range []testcase{
+		{
+			name: "initial rows",
+			rows: []Row{
+				testRow{id: "a"},
+				testRow{},
+				testRow{id: "b"},
+			},
+			presented: []string{"a", "", "b"},
+			alloc:     []string{"a", "b"},
+		},
+		{
+			name: "unchanged rows keep state",
+			rows: []Row{
+				testRow{id: "a"},
+				testRow{},
+				testRow{id: "b"},
+			},
+			presented: []string{"a", "", "b"},
+		},
+		{
+			name: "rows added at both ends",
+			rows: []Row{
+				testRow{id: "z"},
+				testRow{id: "a"},
+				testRow{},
+				testRow{id: "b"},
+				testRow{id: "c"},
+			},
+			presented: []string{"z", "a", "", "b", "c"},
+			alloc:     []string{"z", "c"},
+		},
+		{
+			name: "rows updated in place",
+			rows: []Row{
+				testRow{id: "z"},
+				testRow{id: "a", text: "edited"},
+				testRow{},
+				testRow{id: "b"},
+				testRow{id: "c"},
+			},
+			presented: []string{"z", "a", "", "b", "c"},
+			text:      map[string]string{"a": "edited"},
+		},
+		{
+			name: "rows removed",
+			rows: []Row{
+				testRow{id: "z"},
+				testRow{id: "c"},
+			},
+			presented: []string{"z", "c"},
+		},
+		{
+			name: "removed rows lose their state",
+			rows: []Row{
+				testRow{id: "z"},
+				testRow{id: "a"},
+				testRow{id: "c"},
+			},
+			presented: []string{"z", "a", "c"},
+			alloc:     []string{"a"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h.m.Rows = tc.rows
+			h.alloc = nil
+			h.frame(true)
+			if got := rowIDs(h.presented); !stringsEqual(got, tc.presented) {
+				t.Errorf("expected rows %q to be presented, got %q", tc.presented, got)
+			}
+			if !stringsEqual(h.alloc, tc.alloc) {
+				t.Errorf("expected state allocated for %q, got %q", tc.alloc, h.alloc)
+			}
+			for _, r := range h.presented {
+				if r.id == "" {
+					continue
+				}
+				if s := h.states[r.id]; s == nil || s.id != r.id {
+					t.Errorf("row %q presented with state %v", r.id, s)
+				}
+				if text, ok := tc.text[r.id]; ok && text != r.text {
+					t.Errorf("row %q presented with text %q, expected %q", r.id, r.text, text)
+				}
+			}
+		})
+	}
+}
+
+// TestRowManagerCompaction ensures that a RowManager constructed with
+// NewRowManager only keeps the rows near the viewport, and discards the
+// state of the rest.
+func TestRowManagerCompaction(t *testing.T) {
+	const maxSize = 6
+	h := newRowHarness(image.Pt(100, 20), func(a Allocator, p Presenter) *RowManager {
+		return NewRowManager(maxSize, func() {}, a, p)
+	})
+	defer h.m.Shutdown()
+	for i := 0; i < 50; i++ {
+		h.m.Rows = append(h.m.Rows, testRow{id: string(rune('A' + i))})
+	}
+	// Give the manager a few frames to load around the viewport.
+	for i := 0; i < 10; i++ {
+		h.frame(false)
+		time.Sleep(time.Millisecond)
+	}
+	if l := h.m.UpdatedLen(&h.list); l > maxSize {
+		t.Errorf("expected at most %d rows in memory, got %d", maxSize, l)
+	}
+	if got := rowIDs(h.presented); len(got) == 0 || got[0] != "A" {
+		t.Errorf("expected the first row to be presented first, got %q", got)
+	}
+
+	// Scroll to the end of the rows, allowing the manager to load more
+	// after each frame.
+	for i := 0; i < 100 && !h.presentedID("r"); i++ {
+		h.list.Position.First = h.m.UpdatedLen(&h.list) - 1
+		h.frame(false)
+		time.Sleep(time.Millisecond)
+	}
+	if !h.presentedID("r") {
+		t.Fatalf("failed to scroll to the last row, presented %q", rowIDs(h.presented))
+	}
+
+	// Scrolling back to the start must allocate new state for the first
+	// row, as its state was discarded during compaction.
+	h.alloc = nil
+	for i := 0; i < 100 && !h.presentedID("A"); i++ {
+		h.list.Position.First = 0
+		h.list.Position.Offset = 0
+		h.frame(false)
+		time.Sleep(time.Millisecond)
+	}
+	if !h.presentedID("A") {
+		t.Fatalf("failed to scroll to the first row, presented %q", rowIDs(h.presented))
+	}
+	allocated := false
+	for _, id := range h.alloc {
+		allocated = allocated || id == "A"
+	}
+	if !allocated {
+		t.Errorf("expected state for the first row to be reallocated, allocated %q", h.alloc)
+	}
+}
+
+// presentedID reports whether the row with the given id was presented during
+// the last frame.
+func (h *rowHarness) presentedID(id string) bool {
+	for _, r := range h.presented {
+		if r.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// TestRowManagerPushesChanges ensures that changes to Rows are pushed into the
+// list.Manager incrementally: only the new, changed, or moved rows (along with
+// the boundaries of the rows) and the serials of removed rows.
+func TestRowManagerPushesChanges(t *testing.T) {
+	h := newRowHarness(image.Pt(100, 1000), NewManager)
+	defer h.m.Shutdown()
+	h.m.Rows = []Row{testRow{id: "a"}, testRow{id: "b"}, testRow{id: "c"}, testRow{id: "d"}}
+	h.frame(true)
+
+	for _, tc := range []struct {
+		name string
+		rows []Row
+		// pushed is the serials of the elements expected to be pushed.
+		pushed []string
+		// removed is the serials expected to be removed.
+		removed []list.Serial
+		// presented is the ids of the rows expected to be presented.
+		presented []string
+	}{
+		{
+			name:      "rows added, changed, and removed",
+			rows:      []Row{testRow{id: "a"}, testRow{id: "b", text: "edited"}, testRow{id: "d"}, testRow{id: "e"}},
+			pushed:    []string{string(startSerial), string(endSerial), "b", "e"},
+			removed:   []list.Serial{"c"},
+			presented: []string{"a", "b", "d", "e"},
+		},
+		{
+			name:      "rows moved",
+			rows:      []Row{testRow{id: "d"}, testRow{id: "a"}, testRow{id: "b", text: "edited"}, testRow{id: "e"}},
+			pushed:    []string{string(startSerial), string(endSerial), "a", "b"},
+			presented: []string{"d", "a", "b", "e"},
+		},
+		{
+			name:      "rows unchanged",
+			rows:      []Row{testRow{id: "d"}, testRow{id: "a"}, testRow{id: "b", text: "edited"}, testRow{id: "e"}},
+			presented: []string{"d", "a", "b", "e"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var trace bytes.Buffer
+			h.m.managed().Record(list.NewRecorder(&trace, func(e list.Element) ([]byte, error) {
+				return []byte(e.Serial()), nil
+			}))
+			h.m.Rows = tc.rows
+			h.frame(true)
+			h.m.managed().Record(nil)
+			events, err := list.ReadTrace(&trace)
+			if err != nil {
+				t.Fatalf("reading trace: %v", err)
+			}
+			var (
+				pushed  []string
+				removed []list.Serial
+			)
+			for _, event := range events {
+				if event.Kind != list.TraceModify {
+					continue
+				}
+				for _, data := range event.Elements {
+					pushed = append(pushed, string(data))
+				}
+				removed = append(removed, event.Remove...)
+			}
+			if !stringsEqual(pushed, tc.pushed) {
+				t.Errorf("expected %q to be pushed, got %q", tc.pushed, pushed)
+			}
+			if len(removed) != len(tc.removed) || (len(removed) > 0 && removed[0] != tc.removed[0]) {
+				t.Errorf("expected %q to be removed, got %q", tc.removed, removed)
+			}
+			if got := rowIDs(h.presented); !stringsEqual(got, tc.presented) {
+				t.Errorf("expected rows %q to be presented, got %q", tc.presented, got)
+			}
+		})
+	}
+}
+
+// TestRowManagerDuplicateIDs ensures that rows repeating the ID of an earlier
+// row are presented with state of their own.
+func TestRowManagerDuplicateIDs(t *testing.T) {
+	h := newRowHarness(image.Pt(100, 1000), NewManager)
+	defer h.m.Shutdown()
+	h.m.Rows = []Row{testRow{id: "a"}, testRow{id: "a", text: "again"}, testRow{id: "b"}}
+	h.frame(true)
+	if got, want := rowIDs(h.presented), []string{"a", "a", "b"}; !stringsEqual(got, want) {
+		t.Errorf("expected rows %q to be presented, got %q", want, got)
+	}
+	if want := []string{"a", "a", "b"}; !stringsEqual(h.alloc, want) {
+		t.Errorf("expected state allocated for %q, got %q", want, h.alloc)
+	}
+}
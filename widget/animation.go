@@ -0,0 +1,86 @@
+package widget
+
+import (
+	"time"
+
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/paint"
+	"gioui.org/widget"
+	"git.sr.ht/~gioverse/chat/async/media"
+)
+
+// AnimatedImage plays an animated image, like a widget.Image displaying each
+// frame in turn.
+//
+// Playback only advances while the image is laid out: once it scrolls out of
+// view it pauses, and resumes where it left off when it scrolls back.
+type AnimatedImage struct {
+	// Animation to play. Playback restarts when it changes.
+	Animation *media.Animation
+	// Fit, Position, and Scale lay out each frame like the fields of the
+	// same name of widget.Image.
+	Fit      widget.Fit
+	Position layout.Direction
+	Scale    float32
+	// elapsed is the time the animation has played for.
+	elapsed time.Duration
+	// last is the time of the most recent layout.
+	last time.Time
+	// anim is the animation being played.
+	anim *media.Animation
+}
+
+// pauseThreshold is the time without a layout beyond the expected frame
+// delay after which the animation is considered paused.
+const pauseThreshold = 100 * time.Millisecond
+
+// Layout the current frame of the animation, and schedule an invalidation
+// for when the next frame is due. Nothing is laid out without an animation.
+func (a *AnimatedImage) Layout(gtx layout.Context) layout.Dimensions {
+	src, next := a.frame(gtx, a.Animation)
+	if src == (paint.ImageOp{}) {
+		return layout.Dimensions{}
+	}
+	if !next.IsZero() {
+		op.InvalidateOp{At: next}.Add(gtx.Ops)
+	}
+	return widget.Image{
+		Src:      src,
+		Fit:      a.Fit,
+		Position: a.Position,
+		Scale:    a.Scale,
+	}.Layout(gtx)
+}
+
+// frame returns the frame of anim to display as of gtx.Now, advancing
+// playback, along with the time the next frame is due, if any.
+func (a *AnimatedImage) frame(gtx layout.Context, anim *media.Animation) (paint.ImageOp, time.Time) {
+	if anim == nil || len(anim.Frames) == 0 {
+		return paint.ImageOp{}, time.Time{}
+	}
+	if a.anim != anim {
+		a.anim = anim
+		a.elapsed = 0
+		a.last = gtx.Now
+	}
+	_, remaining := anim.FrameAt(a.elapsed)
+	// Advance by the time since the last layout, unless the animation was not
+	// laid out for long enough to have been out of view.
+	if dt := gtx.Now.Sub(a.last); dt > 0 && dt <= remaining+pauseThreshold {
+		a.elapsed += dt
+	}
+	a.last = gtx.Now
+	index, remaining := anim.FrameAt(a.elapsed)
+	var next time.Time
+	if remaining > 0 {
+		next = gtx.Now.Add(remaining)
+	}
+	return anim.Frames[index], next
+}
+
+// Reset restarts playback from the first frame.
+func (a *AnimatedImage) Reset() {
+	a.elapsed = 0
+	a.anim = nil
+}